@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies(" 10.0.0.0/8, 192.168.1.10 ,,::ffff:172.16.0.1, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.0.0.0/8", "192.168.1.10/32", "172.16.0.1/32", "2001:db8::/32"}
+	if len(proxies) != len(want) {
+		t.Fatalf("got %v; want %v", proxies, want)
+	}
+	for i := range want {
+		if proxies[i].String() != want[i] {
+			t.Errorf("got %s; want %s", proxies[i], want[i])
+		}
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "proxy.example.com", "10.0.0"} {
+		_, err := parseTrustedProxies(s)
+		if err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		want         string
+	}{
+		{"Direct", "203.0.113.7:51234", nil, "", "203.0.113.7"},
+		{"Untrusted headers", "203.0.113.7:51234", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.7"},
+		{"Trusted proxy", "10.0.0.1:51234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"Spoofed entry", "10.0.0.1:51234", []string{"192.0.2.66, 198.51.100.1"}, "", "198.51.100.1"},
+		{"Chained proxies", "10.0.0.1:51234", []string{"198.51.100.1, 10.0.0.2", "10.0.0.3"}, "", "198.51.100.1"},
+		{"Malformed entry", "10.0.0.1:51234", []string{"nonsense, 10.0.0.2"}, "", "10.0.0.2"},
+		{"All trusted", "10.0.0.1:51234", []string{"10.0.0.2"}, "", "10.0.0.2"},
+		{"Real IP", "10.0.0.1:51234", nil, "198.51.100.1", "198.51.100.1"},
+		{"Mapped IPv4", "[::ffff:203.0.113.7]:51234", nil, "", "203.0.113.7"},
+		{"IPv6", "[2001:db8::1]:51234", nil, "", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			got := resolveClientIP(r, proxies)
+			if got != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+type contextKey string
+
+const (
+	clientIPContextKey   = contextKey("client_ip")
+	oauthScopeContextKey = contextKey("oauth_scope")
+	serviceContextKey    = contextKey("service")
+	userContextKey       = contextKey("user")
+)
+
+// contextSetClientIP returns a copy of the request with the IP address of the
+// client that made it added to its context.
+func (app *app) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// clientIP retrieves the IP address of the client that made the request, as
+// resolved by the clientIP middleware. If the middleware has not run, the
+// address of the connection is used.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+
+	return resolveClientIP(r, nil)
+}
+
+// contextSetUser returns a copy of the request with the given User added to
+// its context.
+func (app *app) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser retrieves the User from the request context. It should only
+// be called from handlers wrapped by the authenticate middleware, so a missing
+// value is considered a programming error.
+func (app *app) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
+
+// contextSetService returns a copy of the request with the given Service added
+// to its context.
+func (app *app) contextSetService(r *http.Request, service *data.Service) *http.Request {
+	ctx := context.WithValue(r.Context(), serviceContextKey, service)
+	return r.WithContext(ctx)
+}
+
+// contextGetService retrieves the Service from the request context. Unlike
+// contextGetUser, nil is returned if the request was not made by a service.
+func (app *app) contextGetService(r *http.Request) *data.Service {
+	service, _ := r.Context().Value(serviceContextKey).(*data.Service)
+	return service
+}
+
+// contextSetOAuthScope returns a copy of the request with the scope granted to
+// the OAuth 2.0 client that its access token was issued to added to its
+// context.
+func (app *app) contextSetOAuthScope(r *http.Request, scope []string) *http.Request {
+	ctx := context.WithValue(r.Context(), oauthScopeContextKey, scope)
+	return r.WithContext(ctx)
+}
+
+// contextGetOAuthScope retrieves the scope granted to the OAuth 2.0 client
+// that the request's access token was issued to. The second return value is
+// false if the token was not issued to a client, so is not limited to a scope.
+func (app *app) contextGetOAuthScope(r *http.Request) ([]string, bool) {
+	scope, ok := r.Context().Value(oauthScopeContextKey).([]string)
+	return scope, ok
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// bearerToken extracts the token from a request's "Authorization: Bearer
+// <token>" header. The second return value is false if no such header was
+// provided or it was malformed.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false
+	}
+
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+
+	return token, true
+}
+
+// userETag returns a strong entity tag for the given User based on its version
+// number.
+func userETag(user *data.User) string {
+	return strconv.Quote(strconv.Itoa(user.Version))
+}
+
+// ifMatch reports whether the given entity tag satisfies the request's
+// If-Match header. A request without an If-Match header always matches.
+func ifMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeBareJSON sends data as a JSON response without the JSend envelope. It is
+// used by endpoints whose response format is defined by an external standard,
+// such as OAuth 2.0 and OpenID Connect.
+func (app *app) writeBareJSON(w http.ResponseWriter, status int, data any) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		app.Logger.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
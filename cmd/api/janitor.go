@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"time"
+)
+
+// janitorStats holds the statistics from the most recent run of the token
+// janitor, published alongside the other application metrics. Abandoned
+// WebAuthn ceremonies, forgotten failed sign in attempts by IP address and
+// full rate limit buckets are purged at the same time and included in the
+// counts.
+var janitorStats = expvar.NewMap("token_janitor")
+
+// purgeExpiredTokens periodically deletes expired tokens until ctx is
+// cancelled.
+func (app *app) purgeExpiredTokens(ctx context.Context) {
+	ticker := time.NewTicker(app.cfg.janitor.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			app.purgeExpiredTokensOnce(ctx)
+		}
+	}
+}
+
+// purgeExpiredTokensOnce deletes expired tokens, WebAuthn ceremonies, failed
+// sign in attempts by IP address and rate limit buckets in batches until none
+// remain or ctx is cancelled, then logs and publishes the number deleted.
+func (app *app) purgeExpiredTokensOnce(ctx context.Context) {
+	start := time.Now()
+	var total int64
+	var err error
+
+	purges := []func(int) (int64, error){
+		app.models.Tokens.DeleteExpired,
+		app.models.WebAuthn.DeleteExpiredCeremonies,
+		app.models.LoginFailures.DeleteStale,
+	}
+
+	if app.limiter != nil {
+		purges = append(purges, app.limiter.DeleteExpired)
+	}
+
+	for _, deleteExpired := range purges {
+		for err == nil && ctx.Err() == nil {
+			var deleted int64
+			deleted, err = deleteExpired(app.cfg.janitor.batchSize)
+			total += deleted
+
+			if deleted < int64(app.cfg.janitor.batchSize) {
+				break
+			}
+		}
+	}
+
+	duration := time.Since(start)
+
+	lastError := new(expvar.String)
+	if err != nil {
+		lastError.Set(err.Error())
+		app.Logger.Error("Expired token purge failed", "error", err.Error(), "deleted", total)
+	} else {
+		app.Logger.Info("Expired tokens purged", "deleted", total, "duration", duration.String())
+	}
+
+	lastRun := new(expvar.String)
+	lastRun.Set(start.UTC().Format(time.RFC3339))
+
+	deleted := new(expvar.Int)
+	deleted.Set(total)
+
+	durationMS := new(expvar.Int)
+	durationMS.Set(duration.Milliseconds())
+
+	janitorStats.Set("last_run", lastRun)
+	janitorStats.Set("last_run_deleted", deleted)
+	janitorStats.Set("last_run_duration_ms", durationMS)
+	janitorStats.Set("last_error", lastError)
+	janitorStats.Add("total_deleted", total)
+}
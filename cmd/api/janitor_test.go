@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestPurgeExpiredTokensOnce(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.cfg.janitor.batchSize = 2
+
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+
+	for i := 0; i < 5; i++ {
+		_, err := app.models.Tokens.New(user.ID, -time.Minute, data.ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	live, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.purgeExpiredTokensOnce(context.Background())
+
+	// Every batch is purged in a single run.
+	deleted, ok := janitorStats.Get("last_run_deleted").(*expvar.Int)
+	if !ok || deleted.Value() != 5 {
+		t.Errorf("got %v tokens deleted in the last run; want 5", janitorStats.Get("last_run_deleted"))
+	}
+	if lastError := janitorStats.Get("last_error").String(); lastError != `""` {
+		t.Errorf("got last error %s", lastError)
+	}
+
+	_, err = app.models.Tokens.Get(data.ScopeAuthentication, live.Plaintext)
+	if err != nil {
+		t.Errorf("got %v for a token that has not expired", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// setRetryAfter sets the Retry-After header to the given duration, rounded up
+// to whole seconds.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// accountLockedResponse is sent when a user tries to sign in to an account
+// that is locked due to too many failed attempts.
+func (app *app) accountLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	message := "your account is temporarily locked due to too many failed sign in attempts"
+	app.ErrorResponse(w, r, http.StatusLocked, message)
+}
+
+// loginThrottledResponse is sent when a sign in attempt is made too soon after
+// previous failed attempts.
+func (app *app) loginThrottledResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	message := "too many failed sign in attempts, please try again later"
+	app.ErrorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// loginDelay returns how long a password check for the given user, which is
+// nil if the email address is not registered, from the given IP address must
+// be delayed, and whether that is because the user's account is locked. A
+// zero duration means that the password may be checked now.
+func (app *app) loginDelay(user *data.User, ip string) (time.Duration, bool, error) {
+	now := time.Now()
+
+	ipFailures, err := app.models.LoginFailures.Get(ip)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if d := ipFailures.LockedFor(now); d > 0 {
+		return d, false, nil
+	}
+
+	if user == nil {
+		return 0, false, nil
+	}
+
+	if d := user.LockedFor(now); d > 0 {
+		return d, true, nil
+	}
+
+	return user.DelayedFor(now), false, nil
+}
+
+// checkLoginAllowed reports whether a password may be checked for the given
+// user, which is nil if the email address is not registered, from the given
+// IP address. If not, an appropriate response has been sent.
+func (app *app) checkLoginAllowed(w http.ResponseWriter, r *http.Request, user *data.User, ip string) bool {
+	d, locked, err := app.loginDelay(user, ip)
+	switch {
+	case err != nil:
+		app.ServerErrorResponse(w, r, err)
+	case locked:
+		app.accountLockedResponse(w, r, d)
+	case d > 0:
+		app.loginThrottledResponse(w, r, d)
+	default:
+		return true
+	}
+
+	return false
+}
+
+// countLoginFailure counts a failed sign in attempt from the given IP address
+// against the given user, which is nil if the email address is not registered.
+// If the failure locks the account, the user is emailed a notice and the time
+// until it is unlocked is returned, otherwise zero is returned.
+func (app *app) countLoginFailure(user *data.User, ip string) (time.Duration, error) {
+	err := app.models.LoginFailures.RecordFailure(ip, app.cfg.lockout)
+	if err != nil {
+		return 0, err
+	}
+
+	if user == nil {
+		return 0, nil
+	}
+
+	failures, locked, err := app.models.Users.RecordLoginFailure(user.ID, app.cfg.lockout)
+	if err != nil || !locked {
+		return 0, err
+	}
+
+	app.Logger.Warn("Account locked after failed sign in attempts", "user", user.Email,
+		"ip", ip, "failures", failures.Count)
+
+	app.Background(func() {
+		data := map[string]any{
+			"friendlyName": user.FriendlyName,
+			"name":         user.Name,
+			"ip":           ip,
+			"lockedUntil":  failures.LockedUntil.UTC().Format(time.RFC1123),
+		}
+
+		err := app.mailer.Send(user.Email, "user_account_locked.tmpl", data)
+		if err != nil {
+			app.Logger.Error(err.Error())
+		}
+	})
+
+	return failures.LockedFor(time.Now()), nil
+}
+
+// recordLoginFailure counts a failed sign in attempt from the given IP address
+// against the given user, which is nil if the email address is not registered,
+// and sends the appropriate response.
+func (app *app) recordLoginFailure(w http.ResponseWriter, r *http.Request, user *data.User, ip string) {
+	lockedFor, err := app.countLoginFailure(user, ip)
+	switch {
+	case err != nil:
+		app.ServerErrorResponse(w, r, err)
+	case lockedFor > 0:
+		app.accountLockedResponse(w, r, lockedFor)
+	default:
+		app.InvalidCredentialsResponse(w, r)
+	}
+}
+
+// resetLoginFailures clears the failed sign in attempts against the given user
+// after a successful sign in. Failures from the source IP address are left to
+// be forgotten on their own, as otherwise an attacker could clear them by
+// signing in to their own account between guesses at other accounts.
+func (app *app) resetLoginFailures(user *data.User) error {
+	if user.LoginFailures.Count == 0 && user.LockedUntil == nil {
+		return nil
+	}
+
+	return app.models.Users.ResetLoginFailures(user.ID)
+}
+
+func (app *app) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.userForIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	err := app.models.Users.ResetLoginFailures(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("Account unlocked", "user", user.Email)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// signInRequest returns a request to sign in with the given credentials from
+// the given IP address.
+func signInRequest(email, password, ip string) *http.Request {
+	body := `{"email": "` + email + `", "password": "` + password + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/token", strings.NewReader(body))
+	r.RemoteAddr = ip + ":51234"
+	return r
+}
+
+func TestSignInKeepsIPFailures(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	insertTestUser(t, app, "mallory@example.com", "mallory's own password")
+	insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+
+	const ip = "192.0.2.1"
+
+	for i := 0; i < 2; i++ {
+		rr := serve(app.createAuthTokenHandler, signInRequest("alice@example.com", "guess", ip))
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("got status %d for a wrong password", rr.Code)
+		}
+	}
+
+	// Signing in to their own account does not clear the failures against
+	// the other account from the same address.
+	rr := serve(app.createAuthTokenHandler, signInRequest("mallory@example.com", "mallory's own password", ip))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d for the right password: %s", rr.Code, rr.Body)
+	}
+
+	failures, err := app.models.LoginFailures.Get(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures.Count != 2 {
+		t.Errorf("got %d failures from the IP address; want 2", failures.Count)
+	}
+
+	// The account's own failures are cleared by signing in to it.
+	alice, err := app.models.Users.GetByIdentifier("email", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.LoginFailures.Count != 2 {
+		t.Fatalf("got %d failures against the account; want 2", alice.LoginFailures.Count)
+	}
+
+	err = app.resetLoginFailures(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err = app.models.Users.GetByIdentifier("email", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.LoginFailures.Count != 0 {
+		t.Errorf("got %d failures against the account after a reset; want 0", alice.LoginFailures.Count)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// createMagicLinkTokenHandler emails the user a single-use link that signs
+// them in without a password. The link points at one of the requesting
+// client's registered redirect URIs, and the token in it can only be redeemed
+// by that client along with the PKCE code verifier for the request's S256
+// code challenge. So a link that is intercepted, or requested by someone other
+// than the app that the user is signing in to, is of no use on its own.
+func (app *app) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email         string `json:"email"`
+		ClientID      string `json:"client_id"`
+		RedirectURI   string `json:"redirect_uri"`
+		CodeChallenge string `json:"code_challenge"`
+		DeviceLabel   string `json:"device_label"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	validator.ValidateEmail(v, input.Email)
+	v.Check(input.ClientID != "", "client_id", "must be provided")
+	v.Check(input.CodeChallenge != "", "code_challenge", "must be provided")
+	v.Check(input.CodeChallenge == "" || validator.Matches(input.CodeChallenge, pkceRX),
+		"code_challenge", "must be an S256 PKCE code challenge")
+	data.ValidateDeviceLabel(v, input.DeviceLabel)
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	client, err := app.models.Services.GetByName(input.ClientID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if client == nil || client.Suspended {
+		v.AddError("client_id", "is not a registered client")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// As with authorization requests, the redirect URI may only be omitted if
+	// the client has exactly one registered.
+	if input.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		input.RedirectURI = client.RedirectURIs[0]
+	}
+
+	if !client.HasRedirectURI(input.RedirectURI) {
+		v.AddError("redirect_uri", "is not registered for the client")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// As with password resets, the response does not reveal whether the email
+	// address is registered.
+	message := "if a matching account exists, an email will be sent to it " +
+		"containing a sign in link"
+	env := jsonz.Envelope{"message": message}
+
+	user, err := app.models.Users.GetByIdentifier("email", input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = jsonz.WriteJSendSuccess(w, http.StatusAccepted, nil, env)
+			if err != nil {
+				app.ServerErrorResponse(w, r, err)
+			}
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Suspended {
+		token, err := app.models.Tokens.NewMagicLink(user.ID, client.ID, magicLinkTTL,
+			input.RedirectURI, input.CodeChallenge, sessionMetadata(r, input.DeviceLabel))
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		link, err := url.Parse(input.RedirectURI)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		query := link.Query()
+		query.Set("token", token.Plaintext)
+		link.RawQuery = query.Encode()
+
+		app.Background(func() {
+			data := map[string]any{
+				"friendlyName": user.FriendlyName,
+				"name":         user.Name,
+				"link":         link.String(),
+			}
+
+			err := app.mailer.Send(user.Email, "user_magic_link.tmpl", data)
+			if err != nil {
+				app.Logger.Error(err.Error())
+			}
+		})
+
+		app.Logger.Info("Magic link issued", "user", user.Email, "client", client.Name)
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusAccepted, nil, env)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// redeemMagicLinkTokenHandler exchanges a magic link token for authentication
+// tokens, or a pending token if the user has two-factor authentication
+// enabled. The token is consumed even if it was presented by the wrong
+// client or with the wrong code verifier, so an intercepted link cannot be
+// retried.
+func (app *app) redeemMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		ClientID       string `json:"client_id"`
+		CodeVerifier   string `json:"code_verifier"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	v.Check(input.ClientID != "", "client_id", "must be provided")
+	v.Check(input.CodeVerifier != "", "code_verifier", "must be provided")
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.Consume(data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired sign in token")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	client, err := app.models.Services.GetByName(input.ClientID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if client == nil || client.Suspended || client.ID != token.ClientID {
+		app.Logger.Warn("Magic link redeemed by the wrong client", "client", input.ClientID)
+		v.AddError("token", "invalid or expired sign in token")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !verifyCodeChallenge(input.CodeVerifier, token.CodeChallenge) {
+		app.Logger.Warn("Magic link redeemed with the wrong code verifier", "client", input.ClientID)
+		v.AddError("token", "invalid or expired sign in token")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByIdentifier("id", strconv.FormatInt(token.UserID, 10))
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if user == nil || user.Suspended {
+		v.AddError("token", "invalid or expired sign in token")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.signIn(w, r, user, sessionMetadata(r, token.DeviceLabel))
+}
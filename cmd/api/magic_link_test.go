@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestCreateMagicLinkTokenHandlerRequiresCodeChallenge(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name          string
+		codeChallenge string
+	}{
+		{"Missing", ""},
+		{"Malformed", "too short"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"email": "alice@example.com", "client_id": "webapp", "code_challenge": "` + tt.codeChallenge + `"}`
+			r := httptest.NewRequest(http.MethodPost, "/v1/token/magic-link", strings.NewReader(body))
+
+			rr := serve(app.createMagicLinkTokenHandler, r)
+			if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "code_challenge") {
+				t.Errorf("got status %d: %s; want a code_challenge error", rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestRedeemMagicLinkTokenHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+	client, _ := insertTestService(t, app, "webapp")
+	other, _ := insertTestService(t, app, "otherapp")
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	newLink := func() string {
+		token, err := app.models.Tokens.NewMagicLink(user.ID, client.ID, magicLinkTTL,
+			client.RedirectURIs[0], challenge, data.SessionMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Plaintext
+	}
+
+	redeem := func(token, clientID, verifier string) int {
+		body := `{"token": "` + token + `", "client_id": "` + clientID + `", "code_verifier": "` + verifier + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/token/magic-link/redeem", strings.NewReader(body))
+		return serve(app.redeemMagicLinkTokenHandler, r).Code
+	}
+
+	t.Run("Single use", func(t *testing.T) {
+		token := newLink()
+
+		if code := redeem(token, client.Name, verifier); code != http.StatusCreated {
+			t.Fatalf("got status %d; want %d", code, http.StatusCreated)
+		}
+		if code := redeem(token, client.Name, verifier); code != http.StatusUnprocessableEntity {
+			t.Errorf("got status %d for a used link; want %d", code, http.StatusUnprocessableEntity)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		clientID string
+		verifier string
+	}{
+		{"Other client", other.Name, verifier},
+		{"Unknown client", "unknown", verifier},
+		{"Wrong verifier", client.Name, strings.Repeat("w", 43)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := newLink()
+
+			if code := redeem(token, tt.clientID, tt.verifier); code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d", code, http.StatusUnprocessableEntity)
+			}
+
+			// The failed attempt used the link up.
+			if code := redeem(token, client.Name, verifier); code != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d after a failed attempt; want %d", code, http.StatusUnprocessableEntity)
+			}
+		})
+	}
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
 	"embed"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
+	"net/netip"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	_ "github.com/lib/pq"
 	"github.com/m5lapp/go-service-toolkit/config"
 	"github.com/m5lapp/go-service-toolkit/mailer"
@@ -13,6 +24,7 @@ import (
 	"github.com/m5lapp/go-service-toolkit/vcs"
 	"github.com/m5lapp/go-service-toolkit/webapp"
 	"github.com/m5lapp/go-user-service/internal/data"
+	"github.com/m5lapp/go-user-service/internal/ratelimit"
 	"golang.org/x/exp/slog"
 )
 
@@ -20,15 +32,57 @@ import (
 var templateFS embed.FS
 
 type appConfig struct {
-	db   config.SqlDB
-	smtp config.Smtp
+	db             config.SqlDB
+	smtp           config.Smtp
+	tokenFormat    string
+	trustedProxies []netip.Prefix
+	oidc           struct {
+		issuer string
+	}
+	mfa struct {
+		issuer    string
+		masterKey string
+	}
+	webAuthn struct {
+		rpID      string
+		rpName    string
+		rpOrigins string
+	}
+	lockout   data.LockoutPolicy
+	argon2    data.Argon2Params
+	passwords struct {
+		policy     data.PasswordPolicy
+		breachFile string
+	}
+	rateLimit struct {
+		enabled bool
+		store   string
+	}
+	janitor struct {
+		interval  time.Duration
+		batchSize int
+	}
+	signingKeys struct {
+		masterKey        string
+		algorithm        string
+		rotationInterval time.Duration
+		gracePeriod      time.Duration
+		activeKeys       int
+	}
 }
 
 type app struct {
 	webapp.WebApp
-	cfg    appConfig
-	models data.Models
-	mailer mailer.Mailer
+	cfg      appConfig
+	models   data.Models
+	mailer   mailer.Mailer
+	keys     *data.SigningKeyManager
+	webAuthn *webauthn.WebAuthn
+	// decoyKey derives the IDs of credentials returned for email addresses
+	// without passkeys, so that they are stable but unpredictable.
+	decoyKey []byte
+	limiter  ratelimit.Store
+	workers  sync.WaitGroup
 }
 
 func main() {
@@ -39,6 +93,75 @@ func main() {
 	appCfg.db.Flags("postgres", 25, 25, "15m")
 	appCfg.smtp.Flags("", "")
 
+	flag.StringVar(&appCfg.oidc.issuer, "oidc-issuer", "http://localhost:8080",
+		"OpenID Connect issuer identifier, the external base URL of this service")
+	flag.StringVar(&appCfg.signingKeys.masterKey, "signing-master-key", "",
+		"Base64 encoded 32 byte key used to encrypt signing keys at rest (required)")
+	flag.StringVar(&appCfg.signingKeys.algorithm, "signing-algorithm", data.AlgorithmRS256,
+		"Algorithm of newly generated signing keys (EdDSA|RS256)")
+	flag.DurationVar(&appCfg.signingKeys.rotationInterval, "signing-rotation-interval", 30*24*time.Hour,
+		"How often the signing key is rotated (0 disables scheduled rotation)")
+	flag.DurationVar(&appCfg.signingKeys.gracePeriod, "signing-grace-period", 48*time.Hour,
+		"How long a rotated signing key continues to verify tokens")
+	flag.IntVar(&appCfg.signingKeys.activeKeys, "signing-active-keys", data.DefaultActiveSigningKeys,
+		"Number of published signing keys that have not been rotated, including the one in use")
+
+	flag.StringVar(&appCfg.mfa.issuer, "mfa-issuer", "go-user-service",
+		"Issuer name shown in authenticator apps")
+	flag.StringVar(&appCfg.mfa.masterKey, "mfa-master-key", "",
+		"Base64 encoded 32 byte key used to encrypt TOTP secrets at rest (enrollment is disabled if empty)")
+
+	flag.StringVar(&appCfg.webAuthn.rpID, "webauthn-rp-id", "localhost",
+		"WebAuthn relying party ID, the domain that passkeys are registered to")
+	flag.StringVar(&appCfg.webAuthn.rpName, "webauthn-rp-name", "go-user-service",
+		"WebAuthn relying party name shown by authenticators")
+	flag.StringVar(&appCfg.webAuthn.rpOrigins, "webauthn-rp-origins", "http://localhost:8080",
+		"Comma separated list of origins that WebAuthn ceremonies are allowed from")
+
+	flag.IntVar(&appCfg.lockout.Threshold, "lockout-threshold", 10,
+		"Consecutive failed sign in attempts before an account is locked")
+	flag.IntVar(&appCfg.lockout.IPThreshold, "lockout-ip-threshold", 100,
+		"Consecutive failed sign in attempts from an IP address before it is locked out")
+	flag.DurationVar(&appCfg.lockout.Duration, "lockout-duration", 15*time.Minute,
+		"How long an account or IP address is locked out for")
+
+	var argon2Memory, argon2Iterations, argon2Parallelism uint
+	flag.UintVar(&argon2Memory, "argon2-memory", uint(data.DefaultArgon2Params.Memory),
+		"Memory in KiB used to hash each password with argon2id")
+	flag.UintVar(&argon2Iterations, "argon2-iterations", uint(data.DefaultArgon2Params.Iterations),
+		"Number of iterations used to hash each password with argon2id")
+	flag.UintVar(&argon2Parallelism, "argon2-parallelism", uint(data.DefaultArgon2Params.Parallelism),
+		"Number of threads used to hash each password with argon2id")
+
+	flag.IntVar(&appCfg.passwords.policy.MinLength, "password-min-length", data.DefaultPasswordPolicy.MinLength,
+		"Minimum number of characters in a new password")
+	flag.IntVar(&appCfg.passwords.policy.MinClasses, "password-min-classes", data.DefaultPasswordPolicy.MinClasses,
+		"Minimum number of character classes (lower case, upper case, digits, symbols) in a new password")
+	flag.IntVar(&appCfg.passwords.policy.MinStrength, "password-min-strength", data.DefaultPasswordPolicy.MinStrength,
+		"Minimum estimated strength of a new password, from 0 (too guessable) to 4 (very unguessable)")
+	flag.StringVar(&appCfg.passwords.breachFile, "password-breach-file", "",
+		"Path to a sorted Pwned Passwords SHA-1 file that new passwords are checked against")
+
+	flag.BoolVar(&appCfg.rateLimit.enabled, "ratelimit-enabled", true,
+		"Enable per route rate limiting")
+	flag.StringVar(&appCfg.rateLimit.store, "ratelimit-store", "memory",
+		"Where rate limits are tracked (memory|postgres), postgres shares them between replicas")
+
+	flag.DurationVar(&appCfg.janitor.interval, "token-purge-interval", time.Hour,
+		"How often expired tokens are deleted")
+	flag.IntVar(&appCfg.janitor.batchSize, "token-purge-batch-size", 1000,
+		"Maximum number of expired tokens deleted by each query")
+
+	flag.Func("trusted-proxies",
+		"Comma separated IP addresses and CIDR ranges of proxies whose X-Forwarded-For and X-Real-IP headers are trusted",
+		func(s string) (err error) {
+			appCfg.trustedProxies, err = parseTrustedProxies(s)
+			return err
+		})
+
+	flag.StringVar(&appCfg.tokenFormat, "token-format", data.TokenFormatOpaque,
+		"Format of issued authentication tokens (opaque|jwt)")
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
@@ -50,6 +173,45 @@ func main() {
 
 	logHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{})
 	logger := slog.New(logHandler)
+
+	if appCfg.tokenFormat != data.TokenFormatOpaque && appCfg.tokenFormat != data.TokenFormatJWT {
+		logger.Error(fmt.Sprintf("invalid token format %q", appCfg.tokenFormat), nil)
+		os.Exit(1)
+	}
+
+	if appCfg.janitor.interval <= 0 || appCfg.janitor.batchSize <= 0 {
+		logger.Error("token purge interval and batch size must be positive", nil)
+		os.Exit(1)
+	}
+
+	if appCfg.rateLimit.store != "memory" && appCfg.rateLimit.store != "postgres" {
+		logger.Error(fmt.Sprintf("invalid rate limit store %q", appCfg.rateLimit.store), nil)
+		os.Exit(1)
+	}
+
+	if appCfg.lockout.Threshold <= 0 || appCfg.lockout.IPThreshold <= 0 || appCfg.lockout.Duration <= 0 {
+		logger.Error("lockout thresholds and duration must be positive", nil)
+		os.Exit(1)
+	}
+
+	if argon2Memory < 8*argon2Parallelism || argon2Memory > math.MaxUint32 || argon2Iterations == 0 ||
+		argon2Iterations > math.MaxUint32 || argon2Parallelism == 0 || argon2Parallelism > math.MaxUint8 {
+		logger.Error("invalid argon2 parameters", nil)
+		os.Exit(1)
+	}
+
+	appCfg.argon2 = data.DefaultArgon2Params
+	appCfg.argon2.Memory = uint32(argon2Memory)
+	appCfg.argon2.Iterations = uint32(argon2Iterations)
+	appCfg.argon2.Parallelism = uint8(argon2Parallelism)
+
+	policy := appCfg.passwords.policy
+	if policy.MinLength < 1 || policy.MinLength > 256 || policy.MinClasses < 0 || policy.MinClasses > 4 ||
+		policy.MinStrength < 0 || policy.MinStrength > 4 {
+		logger.Error("invalid password policy", nil)
+		os.Exit(1)
+	}
+
 	db, err := sqldb.OpenDB(appCfg.db)
 	if err != nil {
 		logger.Error(err.Error(), nil)
@@ -59,16 +221,132 @@ func main() {
 
 	logger.Info("Database connection pool established")
 
+	if appCfg.passwords.breachFile != "" {
+		appCfg.passwords.policy.Breached, err = data.OpenBreachedPasswords(appCfg.passwords.breachFile)
+		if err != nil {
+			logger.Error(fmt.Sprintf("invalid password breach file: %s", err), nil)
+			os.Exit(1)
+		}
+		defer appCfg.passwords.policy.Breached.Close()
+	}
+
+	keys, err := openSigningKeys(db, appCfg)
+	if err != nil {
+		logger.Error(err.Error(), nil)
+		os.Exit(1)
+	}
+
+	models := data.NewModels(db)
+
+	if appCfg.mfa.masterKey == "" {
+		logger.Warn("No MFA master key provided, two-factor authentication enrollment is disabled")
+	} else {
+		models.MFA.Box, err = openSecretBox(appCfg.mfa.masterKey)
+		if err != nil {
+			logger.Error(fmt.Sprintf("invalid MFA master key: %s", err), nil)
+			os.Exit(1)
+		}
+	}
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          appCfg.webAuthn.rpID,
+		RPDisplayName: appCfg.webAuthn.rpName,
+		RPOrigins:     strings.Split(appCfg.webAuthn.rpOrigins, ","),
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("invalid WebAuthn configuration: %s", err), nil)
+		os.Exit(1)
+	}
+
+	decoyKey := make([]byte, 32)
+	_, err = rand.Read(decoyKey)
+	if err != nil {
+		logger.Error(err.Error(), nil)
+		os.Exit(1)
+	}
+
 	app := &app{
-		WebApp: webapp.New(serverCfg, logger),
-		cfg:    appCfg,
-		models: data.NewModels(db),
-		mailer: mailer.New(&appCfg.smtp, templateFS),
+		WebApp:   webapp.New(serverCfg, logger),
+		cfg:      appCfg,
+		models:   models,
+		mailer:   mailer.New(&appCfg.smtp, templateFS),
+		keys:     keys,
+		webAuthn: webAuthn,
+		decoyKey: decoyKey,
+	}
+
+	if appCfg.rateLimit.enabled {
+		switch appCfg.rateLimit.store {
+		case "postgres":
+			app.limiter = ratelimit.PostgresStore{DB: db}
+		default:
+			app.limiter = ratelimit.NewMemoryStore()
+		}
 	}
 
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	app.runWorker(ctx, app.rotateSigningKeys)
+	app.runWorker(ctx, app.purgeExpiredTokens)
+
 	err = app.Serve(app.routes())
+
+	// The server has shut down, so stop the background workers and let any
+	// work in progress finish before the database connection pool is closed.
+	stopWorkers()
+	app.workers.Wait()
+
 	if err != nil {
 		logger.Error(err.Error(), nil)
 		os.Exit(1)
 	}
 }
+
+// runWorker runs fn in a background goroutine that is tracked by app.workers.
+// fn should return promptly once ctx is cancelled.
+func (app *app) runWorker(ctx context.Context, fn func(ctx context.Context)) {
+	app.workers.Add(1)
+
+	go func() {
+		defer app.workers.Done()
+		fn(ctx)
+	}()
+}
+
+// openSecretBox creates a SecretBox from a base64 encoded master key.
+func openSecretBox(masterKey string) (*data.SecretBox, error) {
+	key, err := base64.StdEncoding.DecodeString(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return data.NewSecretBox(key)
+}
+
+// openSigningKeys creates the manager for the keys used to sign tokens and
+// loads them from the database. ID tokens are always signed, so a master key
+// to encrypt the stored keys must be configured. Without one, each instance
+// of the service would sign with keys of its own that are lost on restart.
+func openSigningKeys(db *sql.DB, cfg appConfig) (*data.SigningKeyManager, error) {
+	if cfg.signingKeys.masterKey == "" {
+		return nil, errors.New("a signing master key must be provided with -signing-master-key")
+	}
+
+	if cfg.signingKeys.activeKeys < 1 {
+		return nil, errors.New("at least one signing key must be active")
+	}
+
+	masterKey, err := base64.StdEncoding.DecodeString(cfg.signingKeys.masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing master key: %w", err)
+	}
+
+	keys, err := data.NewSigningKeyManager(db, masterKey, cfg.signingKeys.algorithm,
+		cfg.signingKeys.rotationInterval, cfg.signingKeys.gracePeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.ActiveKeys = cfg.signingKeys.activeKeys
+
+	return keys, keys.Load()
+}
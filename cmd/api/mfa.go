@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+const (
+	// mfaPendingTTL is how long a user has to provide their second factor
+	// after providing their password.
+	mfaPendingTTL = 5 * time.Minute
+	// totpQRCodeSize is the width and height in pixels of the QR code returned
+	// when enrolling.
+	totpQRCodeSize = 256
+)
+
+// verifySecondFactor checks code against the given user's confirmed TOTP
+// secret, or failing that, their unused recovery codes. A successful code is
+// marked as used so that it cannot be used again.
+func (app *app) verifySecondFactor(user *data.User, code string) (bool, error) {
+	t, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		// Without the master key, TOTP codes cannot be checked, but recovery
+		// codes still can.
+		case !errors.Is(err, data.ErrMFANotConfigured):
+			return false, err
+		}
+	}
+
+	if t != nil {
+		if !t.Confirmed() {
+			return false, nil
+		}
+
+		if step, ok := t.Verify(code, time.Now()); ok {
+			return app.models.MFA.UseTOTPStep(user.ID, step)
+		}
+	}
+
+	used, err := app.models.MFA.UseRecoveryCode(user.ID, code)
+	if err != nil {
+		return false, err
+	}
+
+	if used {
+		app.Logger.Warn("Recovery code used", "user", user.Email)
+	}
+
+	return used, nil
+}
+
+// mfaNotConfiguredResponse is sent when a user tries to enroll in two-factor
+// authentication but no MFA master key has been configured.
+func (app *app) mfaNotConfiguredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is not available"
+	app.ErrorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *app) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	key, err := data.GenerateTOTPKey(app.cfg.mfa.issuer, user.Email)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	recoveryCodes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.Enroll(user.ID, key.Secret(), recoveryCodes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrMFAAlreadyEnabled):
+			message := "two-factor authentication is already enabled"
+			app.ErrorResponse(w, r, http.StatusConflict, message)
+		case errors.Is(err, data.ErrMFANotConfigured):
+			app.mfaNotConfiguredResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	img, err := key.Image(totpQRCodeSize, totpQRCodeSize)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	var qrCode bytes.Buffer
+	err = png.Encode(&qrCode, img)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	totp := map[string]any{
+		"secret":         key.Secret(),
+		"otpauth_uri":    key.URL(),
+		"qr_code":        "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrCode.Bytes()),
+		"recovery_codes": recoveryCodes,
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusCreated, nil, jsonz.Envelope{"totp": totp})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateMFACode(v, input.Code)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	t, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		case errors.Is(err, data.ErrMFANotConfigured):
+			app.mfaNotConfiguredResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Confirmed() {
+		message := "two-factor authentication is already enabled"
+		app.ErrorResponse(w, r, http.StatusConflict, message)
+		return
+	}
+
+	step, ok := t.Verify(input.Code, time.Now())
+	if ok {
+		ok, err = app.models.MFA.UseTOTPStep(user.ID, step)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !ok {
+		v.AddError("code", "is not valid")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.Logger.Info("Two-factor authentication enabled", "user", user.Email)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// disableTOTPHandler turns off two-factor authentication for the current user.
+// Both their password and a current code are required, so that a stolen
+// authentication token alone is not enough to remove the second factor. Wrong
+// passwords count as failed sign in attempts.
+func (app *app) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateMFACode(v, input.Code)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ip := clientIP(r)
+
+	if !app.checkLoginAllowed(w, r, user, ip) {
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password, app.cfg.argon2)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.recordLoginFailure(w, r, user, ip)
+		return
+	}
+
+	enabled, err := app.models.MFA.IsEnabled(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !enabled {
+		app.NotFoundResponse(w, r)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user, input.Code)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "is not valid")
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.MFA.Disable(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("Two-factor authentication disabled", "user", user.Email)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// createMFATokenHandler completes a two-step sign in, exchanging the token
+// issued after a successful password check and a valid second factor for
+// authentication tokens. The pending token is consumed whether or not the
+// code is valid, so a wrong code means signing in again.
+func (app *app) createMFATokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.MFAToken)
+	data.ValidateMFACode(v, input.Code)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	pending, err := app.models.Tokens.Consume(data.ScopeMFAPending, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.InvalidAuthenticationTokenResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.GetByIdentifier("id", strconv.FormatInt(pending.UserID, 10))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.InvalidAuthenticationTokenResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user, input.Code)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.InvalidCredentialsResponse(w, r)
+		return
+	}
+
+	if !user.CanSignIn() {
+		app.accountInactiveResponse(w, r)
+		return
+	}
+
+	app.issueAuthTokens(w, r, user, nil, sessionMetadata(r, pending.DeviceLabel))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+	"github.com/m5lapp/go-user-service/internal/ratelimit"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestDisableTOTPHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	box, err := data.NewSecretBox(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.models.MFA.Box = box
+
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+
+	key, err := data.GenerateTOTPKey("go-user-service", user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recoveryCodes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.MFA.Enroll(user.ID, key.Secret(), recoveryCodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := totp.GenerateCode(key.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.models.MFA.UseTOTPStep(user.ID, time.Now().Unix()/30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disable := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/v1/user/mfa/totp", bytes.NewBufferString(body))
+		r.RemoteAddr = "192.0.2.1:51234"
+		r = app.contextSetUser(r, user)
+		return serve(app.disableTOTPHandler, r)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"No password", `{"code": "` + recoveryCodes[0] + `"}`, http.StatusUnprocessableEntity},
+		{"Wrong password", `{"password": "guess", "code": "` + recoveryCodes[0] + `"}`, http.StatusUnauthorized},
+		{"Wrong code", `{"password": "correct horse battery staple", "code": "000000-000000"}`, http.StatusUnprocessableEntity},
+		{"Used code", `{"password": "correct horse battery staple", "code": "` + code + `"}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := disable(tt.body)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+
+			enabled, err := app.models.MFA.IsEnabled(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !enabled {
+				t.Fatal("two-factor authentication was disabled")
+			}
+		})
+	}
+
+	// The wrong password counts as a failed sign in attempt.
+	stored, err := app.models.Users.GetByIdentifier("email", user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LoginFailures.Count != 1 {
+		t.Errorf("got %d failures against the account; want 1", stored.LoginFailures.Count)
+	}
+
+	rr := disable(`{"password": "correct horse battery staple", "code": "` + recoveryCodes[0] + `"}`)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusNoContent, rr.Body)
+	}
+
+	enabled, err := app.models.MFA.IsEnabled(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled {
+		t.Error("two-factor authentication is still enabled")
+	}
+}
+
+func TestDisableTOTPRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	app.limiter = ratelimit.NewMemoryStore()
+	routes := app.routes()
+
+	send := func(method, path string) int {
+		r := httptest.NewRequest(method, path, bytes.NewBufferString(`{}`))
+		r.RemoteAddr = "192.0.2.1:51234"
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	for i := 0; i < 10; i++ {
+		code := send(http.MethodDelete, "/v1/user/mfa/totp")
+		if code == http.StatusTooManyRequests {
+			t.Fatalf("request %d was rate limited", i+1)
+		}
+	}
+
+	// Disabling two-factor authentication shares the limit for checking
+	// second factors when signing in.
+	if code := send(http.MethodPost, "/v1/token/mfa"); code != http.StatusTooManyRequests {
+		t.Errorf("got status %d; want %d", code, http.StatusTooManyRequests)
+	}
+	if code := send(http.MethodDelete, "/v1/user/mfa/totp"); code != http.StatusTooManyRequests {
+		t.Errorf("got status %d; want %d", code, http.StatusTooManyRequests)
+	}
+}
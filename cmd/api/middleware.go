@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/m5lapp/go-user-service/internal/data"
+	"golang.org/x/exp/slices"
+)
+
+// clientIP resolves the IP address of the client that made the request, taking
+// the trusted proxies into account, and stores it in the request context.
+func (app *app) clientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetClientIP(r, resolveClientIP(r, app.cfg.trustedProxies))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate resolves the bearer token in the request's Authorization header
+// to a User and stores it in the request context. Requests without an
+// Authorization header, or whose header uses another scheme such as the Basic
+// client authentication on the OAuth 2.0 endpoints, are given the
+// AnonymousUser. Tokens owned by a service rather than a user are resolved to
+// a Service, which is stored alongside the AnonymousUser.
+func (app *app) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tokenPlaintext, ok := bearerToken(r)
+		if !ok {
+			app.InvalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		if !data.IsJWT(tokenPlaintext) {
+			v := validator.New()
+			data.ValidateTokenPlaintext(v, tokenPlaintext)
+			if !v.Valid() {
+				app.InvalidAuthenticationTokenResponse(w, r)
+				return
+			}
+		}
+
+		user, err := app.userForToken(tokenPlaintext)
+		if err == nil {
+			if !data.IsJWT(tokenPlaintext) {
+				token, err := app.models.Tokens.Get(data.ScopeAuthentication, tokenPlaintext)
+				if err != nil {
+					switch {
+					case errors.Is(err, data.ErrRecordNotFound):
+						app.InvalidAuthenticationTokenResponse(w, r)
+					default:
+						app.ServerErrorResponse(w, r, err)
+					}
+					return
+				}
+
+				r = app.withOAuthScope(r, token)
+				app.touchSession(r, token)
+			}
+
+			r = app.contextSetUser(r, user)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		service, err := app.models.Services.GetForToken(data.ScopeAuthentication, tokenPlaintext)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.InvalidAuthenticationTokenResponse(w, r)
+			default:
+				app.ServerErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		token, err := app.models.Tokens.Get(data.ScopeAuthentication, tokenPlaintext)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.InvalidAuthenticationTokenResponse(w, r)
+			default:
+				app.ServerErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r = app.withOAuthScope(r, token)
+		r = app.contextSetUser(r, data.AnonymousUser)
+		r = app.contextSetService(r, service)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withOAuthScope returns a copy of the request with the scope granted to the
+// OAuth 2.0 client that the opaque access token was issued to added to its
+// context. If the token was not issued to a client, the request is returned
+// unchanged.
+func (app *app) withOAuthScope(r *http.Request, token *data.Token) *http.Request {
+	if token.ClientID == 0 {
+		return r
+	}
+
+	return app.contextSetOAuthScope(r, strings.Fields(token.OAuthScope))
+}
+
+// requireAuthenticatedUser rejects requests made by the AnonymousUser, or with
+// an access token issued to an OAuth 2.0 client.
+func (app *app) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.AuthenticationRequiredResponse(w, r)
+			return
+		}
+
+		// Access tokens issued to OAuth 2.0 clients only grant the
+		// permissions in their scope, not control of the user's account.
+		if _, ok := app.contextGetOAuthScope(r); ok {
+			app.NotPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requireActivatedUser rejects requests made by the AnonymousUser, with an
+// access token issued to an OAuth 2.0 client, or by a user that has not yet
+// activated their account.
+func (app *app) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if !user.Activated {
+			app.InactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requireActivatedUserOrClient is like requireActivatedUser, but also accepts
+// access tokens issued to OAuth 2.0 clients, leaving the handler to check the
+// scope that they were granted.
+func (app *app) requireActivatedUserOrClient(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		switch {
+		case user.IsAnonymous():
+			app.AuthenticationRequiredResponse(w, r)
+			return
+		case !user.Activated:
+			app.InactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requirePermission rejects requests made by principals that do not hold the
+// permission with the given code. Users must also be activated, whereas
+// services hold the permissions that they own. Access tokens issued to OAuth
+// 2.0 clients must also have been granted the permission in their scope.
+func (app *app) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		service := app.contextGetService(r)
+
+		if service == nil {
+			switch {
+			case user.IsAnonymous():
+				app.AuthenticationRequiredResponse(w, r)
+				return
+			case !user.Activated:
+				app.InactiveAccountResponse(w, r)
+				return
+			}
+		}
+
+		// Access tokens issued to OAuth 2.0 clients are limited to the
+		// permissions that are also in the scope that they were granted.
+		if scope, ok := app.contextGetOAuthScope(r); ok && !slices.Contains(scope, code) {
+			app.NotPermittedResponse(w, r)
+			return
+		}
+
+		var permissions data.Permissions
+		var err error
+
+		if service != nil {
+			permissions, err = app.models.Permissions.GetAllForService(service.ID)
+		} else {
+			permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+		}
+
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			app.NotPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
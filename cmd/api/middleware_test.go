@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestRequireAuthenticatedUser(t *testing.T) {
+	app := newTestApplication(t)
+	user := &data.User{ID: 1, Activated: true}
+
+	tests := []struct {
+		name       string
+		user       *data.User
+		oauthScope []string
+		wantCode   int
+	}{
+		{"Anonymous", data.AnonymousUser, nil, http.StatusUnauthorized},
+		{"User token", user, nil, http.StatusOK},
+		{"Client token", user, []string{"openid", "users:read"}, http.StatusForbidden},
+		{"Client token without scope", user, []string{}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/user/sessions", nil)
+			r = app.contextSetUser(r, tt.user)
+			if tt.oauthScope != nil {
+				r = app.contextSetOAuthScope(r, tt.oauthScope)
+			}
+
+			rr := serve(app.requireAuthenticatedUser(okHandler), r)
+			if rr.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRequireActivatedUserOrClient(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name       string
+		user       *data.User
+		oauthScope []string
+		wantCode   int
+	}{
+		{"Anonymous", data.AnonymousUser, nil, http.StatusUnauthorized},
+		{"User token", &data.User{ID: 1, Activated: true}, nil, http.StatusOK},
+		{"Client token", &data.User{ID: 1, Activated: true}, []string{"openid"}, http.StatusOK},
+		{"Not activated", &data.User{ID: 1}, []string{"openid"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+			r = app.contextSetUser(r, tt.user)
+			if tt.oauthScope != nil {
+				r = app.contextSetOAuthScope(r, tt.oauthScope)
+			}
+
+			rr := serve(app.requireActivatedUserOrClient(okHandler), r)
+			if rr.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// The permission checks that need the database are not covered here, only
+// those that are made before it is queried.
+func TestRequirePermissionOAuthScope(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name     string
+		user     *data.User
+		service  *data.Service
+		wantCode int
+	}{
+		{"Anonymous", data.AnonymousUser, nil, http.StatusUnauthorized},
+		{"Not activated", &data.User{ID: 1}, nil, http.StatusForbidden},
+		{"User outside scope", &data.User{ID: 1, Activated: true}, nil, http.StatusForbidden},
+		{"Service outside scope", data.AnonymousUser, &data.Service{ID: 1}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/user/id/1", nil)
+			r = app.contextSetUser(r, tt.user)
+			if tt.service != nil {
+				r = app.contextSetService(r, tt.service)
+			}
+			r = app.contextSetOAuthScope(r, []string{"openid", "users:write"})
+
+			rr := serve(app.requirePermission("users:read", okHandler), r)
+			if rr.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	activated := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+
+	inactive := &data.User{Email: "bob@example.com", Name: "Test User"}
+
+	err := inactive.Password.Set("correct horse battery staple", app.cfg.argon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Users.Insert(inactive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newToken := func(user *data.User, ttl time.Duration, scope string) string {
+		token, err := app.models.Tokens.New(user.ID, ttl, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Plaintext
+	}
+
+	activatedToken := newToken(activated, time.Hour, data.ScopeAuthentication)
+
+	// whoami responds with the email address of the user in the context.
+	whoami := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			w.Write([]byte("anonymous"))
+			return
+		}
+		w.Write([]byte(user.Email))
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		handler       http.HandlerFunc
+		wantCode      int
+		wantBody      string
+	}{
+		{"No header", "", whoami, http.StatusOK, "anonymous"},
+		{"No header on a protected route", "", app.requireAuthenticatedUser(okHandler), http.StatusUnauthorized, ""},
+		{"Malformed header", "Bearer", whoami, http.StatusUnauthorized, ""},
+		{"Malformed token", "Bearer not-a-token", whoami, http.StatusUnauthorized, ""},
+		{"Unknown token", "Bearer ABCDEFGHIJKLMNOPQRSTUVWXYZ", whoami, http.StatusUnauthorized, ""},
+		{"Expired token", "Bearer " + newToken(activated, -time.Minute, data.ScopeAuthentication), whoami, http.StatusUnauthorized, ""},
+		{"Token of another scope", "Bearer " + newToken(activated, time.Hour, data.ScopeActivation), whoami, http.StatusUnauthorized, ""},
+		{"Valid token", "Bearer " + activatedToken, whoami, http.StatusOK, activated.Email},
+		{"Valid token on a protected route", "Bearer " + activatedToken, app.requireActivatedUser(okHandler), http.StatusOK, "OK"},
+		{"Inactive user", "Bearer " + newToken(inactive, time.Hour, data.ScopeAuthentication), app.requireActivatedUser(okHandler), http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/user", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+
+			rr := httptest.NewRecorder()
+			app.authenticate(tt.handler).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantCode, rr.Body)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("got body %q; want %q", rr.Body, tt.wantBody)
+			}
+			if rr.Header().Get("Vary") != "Authorization" {
+				t.Errorf("got Vary %q; want Authorization", rr.Header().Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	app := newTestDBApplication(t)
+	routes := app.routes()
+
+	alice := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+	bob := insertTestUser(t, app, "bob@example.com", "correct horse battery staple")
+
+	token, err := app.models.Tokens.New(alice.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getBob := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/v1/user/email/"+bob.Email, nil)
+		r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	if code := getBob(); code != http.StatusForbidden {
+		t.Errorf("got status %d without the permission; want %d", code, http.StatusForbidden)
+	}
+
+	// Holding a different permission is not enough.
+	err = app.models.Permissions.AddForUser(alice.ID, "users:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := getBob(); code != http.StatusForbidden {
+		t.Errorf("got status %d with another permission; want %d", code, http.StatusForbidden)
+	}
+
+	err = app.models.Permissions.AddForUser(alice.ID, "users:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := getBob(); code != http.StatusOK {
+		t.Errorf("got status %d with the permission; want %d", code, http.StatusOK)
+	}
+}
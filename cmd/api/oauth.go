@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// oauthAccessTokenTTL is how long an access token issued through the OAuth 2.0
+// token endpoint is valid.
+const oauthAccessTokenTTL = time.Hour
+
+// Error codes defined by RFC 6749 section 5.2.
+const (
+	oauthErrInvalidRequest       = "invalid_request"
+	oauthErrInvalidClient        = "invalid_client"
+	oauthErrInvalidGrant         = "invalid_grant"
+	oauthErrInvalidScope         = "invalid_scope"
+	oauthErrUnsupportedGrantType = "unsupported_grant_type"
+)
+
+// oauthTokenResponse is a successful access token response as described in RFC
+// 6749 section 5.1.
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// writeOAuthJSON sends data as a JSON response. OAuth 2.0 endpoints do not use
+// the JSend envelope, and their responses must never be cached.
+func (app *app) writeOAuthJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	app.writeBareJSON(w, status, data)
+}
+
+// oauthErrorResponse sends an error response in the format described in RFC
+// 6749 section 5.2.
+func (app *app) oauthErrorResponse(w http.ResponseWriter, status int, code, description string) {
+	if code == oauthErrInvalidClient {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+
+	app.writeOAuthJSON(w, status, body)
+}
+
+// oauthServerErrorResponse logs err and sends an RFC 6749 style server_error
+// response.
+func (app *app) oauthServerErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.Logger.Error(err.Error(), "method", r.Method, "uri", r.URL.RequestURI())
+	app.oauthErrorResponse(w, http.StatusInternalServerError, "server_error", "")
+}
+
+// authenticateClient authenticates the OAuth 2.0 client using HTTP Basic
+// authentication against the services table. If authentication fails, an
+// appropriate error response is sent and nil is returned.
+func (app *app) authenticateClient(w http.ResponseWriter, r *http.Request) *data.Service {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		app.oauthErrorResponse(w, http.StatusUnauthorized, oauthErrInvalidClient,
+			"client authentication is required")
+		return nil
+	}
+
+	// RFC 6749 section 2.3.1 requires the credentials to be form-encoded
+	// before they are base64 encoded.
+	clientID, errID := url.QueryUnescape(clientID)
+	clientSecret, errSecret := url.QueryUnescape(clientSecret)
+	if errID != nil || errSecret != nil {
+		app.oauthErrorResponse(w, http.StatusUnauthorized, oauthErrInvalidClient,
+			"malformed client credentials")
+		return nil
+	}
+
+	service, err := app.models.Services.GetByName(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, http.StatusUnauthorized, oauthErrInvalidClient,
+				"invalid client credentials")
+		default:
+			app.oauthServerErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	match, err := service.Password.Matches(clientSecret, app.cfg.argon2)
+	if err != nil {
+		app.oauthServerErrorResponse(w, r, err)
+		return nil
+	}
+
+	if !match || service.Suspended {
+		app.oauthErrorResponse(w, http.StatusUnauthorized, oauthErrInvalidClient,
+			"invalid client credentials")
+		return nil
+	}
+
+	return service
+}
+
+func (app *app) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidRequest,
+			"the request body must be form encoded")
+		return
+	}
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case "authorization_code":
+		app.authorizationCodeGrant(w, r)
+	case "client_credentials":
+		app.clientCredentialsGrant(w, r)
+	case "":
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidRequest,
+			"grant_type must be provided")
+	default:
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrUnsupportedGrantType, "")
+	}
+}
+
+// clientCredentialsGrant issues an access token to a service as described in
+// RFC 6749 section 4.4. The granted scope is every permission the service
+// owns; a narrower scope may be requested, but it must be a subset of those
+// permissions.
+func (app *app) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	service := app.authenticateClient(w, r)
+	if service == nil {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForService(service.ID)
+	if err != nil {
+		app.oauthServerErrorResponse(w, r, err)
+		return
+	}
+
+	// A request without a scope is granted every permission that the service
+	// owns (RFC 6749 section 3.3).
+	granted := strings.Fields(r.PostForm.Get("scope"))
+	if len(granted) == 0 {
+		granted = permissions
+	}
+
+	for _, scope := range granted {
+		if !permissions.Include(scope) {
+			app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidScope,
+				"the requested scope exceeds the scope granted to the client")
+			return
+		}
+	}
+
+	scope := strings.Join(granted, " ")
+
+	token, err := app.models.Tokens.NewForServiceClient(service.ID, oauthAccessTokenTTL,
+		data.ScopeAuthentication, scope)
+	if err != nil {
+		app.oauthServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("OAuth client credentials grant issued", "service", service.Name)
+
+	app.writeOAuthJSON(w, http.StatusOK, oauthTokenResponse{
+		AccessToken: token.Plaintext,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oauthAccessTokenTTL.Seconds()),
+		Scope:       scope,
+	})
+}
+
+// oauthRevokeHandler revokes an access token as described in RFC 7009. A
+// client can only revoke tokens that were issued to it. As the RFC requires,
+// a successful response is sent for unknown or already invalid tokens so that
+// clients cannot use this endpoint to probe for valid tokens.
+func (app *app) oauthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidRequest,
+			"the request body must be form encoded")
+		return
+	}
+
+	client := app.authenticatePublicOrConfidentialClient(w, r)
+	if client == nil {
+		return
+	}
+
+	tokenPlaintext := r.PostForm.Get("token")
+	if tokenPlaintext == "" {
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidRequest,
+			"token must be provided")
+		return
+	}
+
+	// The token_type_hint parameter is ignored, since only access tokens are
+	// issued to OAuth 2.0 clients.
+	token, err := app.models.Tokens.Get(data.ScopeAuthentication, tokenPlaintext)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.oauthServerErrorResponse(w, r, err)
+		return
+	}
+
+	if err == nil && (token.ClientID == client.ID || token.ServiceID == client.ID) {
+		err = app.models.Tokens.DeleteByHash(token.Hash)
+		if err != nil {
+			app.oauthServerErrorResponse(w, r, err)
+			return
+		}
+
+		app.Logger.Info("OAuth token revoked", "client", client.Name)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/m5lapp/go-user-service/internal/data"
+	"golang.org/x/exp/slices"
+)
+
+// authorizationCodeTTL is how long an OAuth 2.0 authorization code is valid.
+// RFC 6749 section 4.1.2 recommends a maximum of ten minutes.
+const authorizationCodeTTL = 10 * time.Minute
+
+// authorizeCSRFCookie is the cookie holding the random secret that the CSRF
+// tokens on the sign in page are derived from.
+const authorizeCSRFCookie = "authorize_csrf"
+
+// pkceRX matches PKCE code verifiers and S256 code challenges, both of which
+// are made up of 43 to 128 unreserved characters (RFC 7636 section 4.1).
+var pkceRX = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// authorizationRequest holds the parameters of an OAuth 2.0 authorization
+// request (RFC 6749 section 4.1.1) along with the PKCE extension parameters
+// (RFC 7636 section 4.3).
+type authorizationRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+}
+
+func newAuthorizationRequest(values url.Values) *authorizationRequest {
+	return &authorizationRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+		Nonce:               values.Get("nonce"),
+	}
+}
+
+// authorizePage holds the data used to render the oauth_authorize.tmpl page.
+type authorizePage struct {
+	Client  *data.Service
+	Request *authorizationRequest
+	Scopes  []string
+	Email   string
+	Error   string
+	Fatal   string
+	// MFAToken is the pending MFA token issued once the password has been
+	// checked, which replaces the password fields with a field for a
+	// two-factor authentication code.
+	MFAToken string
+	// CSRFToken ties the form to the browser that it was rendered for and to
+	// the authorization request in it.
+	CSRFToken string
+}
+
+// renderAuthorizePage renders the sign in and consent page. The page must not
+// be cached or framed by another site.
+func (app *app) renderAuthorizePage(w http.ResponseWriter, r *http.Request, status int, page *authorizePage) {
+	ts, err := template.ParseFS(templateFS, "templates/oauth_authorize.tmpl")
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if page.Request != nil {
+		secret, err := authorizeCSRFSecret(w, r)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		page.CSRFToken = authorizeCSRFToken(secret, page.Request)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+
+	err = ts.ExecuteTemplate(w, "page", page)
+	if err != nil {
+		app.Logger.Error(err.Error())
+	}
+}
+
+// authorizeCSRFSecret returns the CSRF secret from the request's cookie,
+// setting a new one if it has none. The cookie is not sent with cross-site
+// form posts, so another site cannot submit the sign in form for the user.
+func authorizeCSRFSecret(w http.ResponseWriter, r *http.Request) (string, error) {
+	cookie, err := r.Cookie(authorizeCSRFCookie)
+	if err == nil && len(cookie.Value) == 43 {
+		return cookie.Value, nil
+	}
+
+	randomBytes := make([]byte, 32)
+
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     authorizeCSRFCookie,
+		Value:    secret,
+		Path:     "/oauth/authorize",
+		MaxAge:   int(time.Hour.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return secret, nil
+}
+
+// authorizeCSRFToken derives the CSRF token for a form containing req from
+// the browser's CSRF secret, so that a token taken from one form cannot be
+// used to submit a different authorization request.
+func authorizeCSRFToken(secret string, req *authorizationRequest) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	for _, value := range []string{req.ResponseType, req.ClientID, req.RedirectURI,
+		req.Scope, req.State, req.CodeChallenge, req.CodeChallengeMethod, req.Nonce} {
+		mac.Write([]byte(strconv.Itoa(len(value))))
+		mac.Write([]byte{':'})
+		mac.Write([]byte(value))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkAuthorizeCSRF reports whether the submitted sign in form carries the
+// CSRF token for its authorization request and the browser's CSRF secret.
+func checkAuthorizeCSRF(r *http.Request, req *authorizationRequest) bool {
+	cookie, err := r.Cookie(authorizeCSRFCookie)
+	if err != nil {
+		return false
+	}
+
+	want := authorizeCSRFToken(cookie.Value, req)
+	return hmac.Equal([]byte(r.PostForm.Get("csrf_token")), []byte(want))
+}
+
+// renderAuthorizeLoginDelayed renders the sign in page when a password cannot
+// be checked for d because of earlier failed attempts, and whether that is
+// because the account is locked, in the same way as checkLoginAllowed.
+func (app *app) renderAuthorizeLoginDelayed(w http.ResponseWriter, r *http.Request, page *authorizePage, d time.Duration, locked bool) {
+	setRetryAfter(w, d)
+
+	if locked {
+		page.Error = "Your account is temporarily locked due to too many failed sign in attempts."
+		app.renderAuthorizePage(w, r, http.StatusLocked, page)
+		return
+	}
+
+	page.Error = "Too many failed sign in attempts, please try again later."
+	app.renderAuthorizePage(w, r, http.StatusTooManyRequests, page)
+}
+
+// redirectAuthorizationError sends the user agent back to the client with an
+// RFC 6749 section 4.1.2.1 error response.
+func (app *app) redirectAuthorizationError(w http.ResponseWriter, r *http.Request, req *authorizationRequest, code, description string) {
+	params := url.Values{"error": {code}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	http.Redirect(w, r, appendQuery(req.RedirectURI, params), http.StatusFound)
+}
+
+// appendQuery adds params to the query string of uri, preserving any query
+// parameters it already has.
+func appendQuery(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// checkAuthorizationRequest validates an authorization request and returns the
+// client that it was made by. Problems with the client or redirect URI are
+// shown to the user, as redirecting to an unverified URI would make this an
+// open redirector; any other problem is reported back to the client. In both
+// cases the response has been sent and nil is returned.
+func (app *app) checkAuthorizationRequest(w http.ResponseWriter, r *http.Request, req *authorizationRequest) *data.Service {
+	client, err := app.models.Services.GetByName(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.renderAuthorizePage(w, r, http.StatusBadRequest,
+				&authorizePage{Fatal: "The application is not registered."})
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	// The redirect URI may only be omitted if the client has exactly one
+	// registered (RFC 6749 section 3.1.2.3).
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+
+	if client.Suspended || !client.HasRedirectURI(req.RedirectURI) {
+		app.renderAuthorizePage(w, r, http.StatusBadRequest,
+			&authorizePage{Fatal: "The application's redirect URI is not registered."})
+		return nil
+	}
+
+	switch {
+	case req.ResponseType != "code":
+		app.redirectAuthorizationError(w, r, req, "unsupported_response_type",
+			"only the code response type is supported")
+	case req.CodeChallenge == "":
+		app.redirectAuthorizationError(w, r, req, oauthErrInvalidRequest,
+			"code_challenge must be provided")
+	case req.CodeChallengeMethod != "S256":
+		app.redirectAuthorizationError(w, r, req, oauthErrInvalidRequest,
+			"code_challenge_method must be S256")
+	case !validator.Matches(req.CodeChallenge, pkceRX):
+		app.redirectAuthorizationError(w, r, req, oauthErrInvalidRequest,
+			"code_challenge is malformed")
+	case len(req.Scope) > 1000:
+		app.redirectAuthorizationError(w, r, req, oauthErrInvalidScope,
+			"scope must not be more than 1000 bytes long")
+	case len(req.Nonce) > 255:
+		app.redirectAuthorizationError(w, r, req, oauthErrInvalidRequest,
+			"nonce must not be more than 255 bytes long")
+	default:
+		return client
+	}
+
+	return nil
+}
+
+func (app *app) showAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	req := newAuthorizationRequest(r.URL.Query())
+
+	client := app.checkAuthorizationRequest(w, r, req)
+	if client == nil {
+		return
+	}
+
+	app.renderAuthorizePage(w, r, http.StatusOK, &authorizePage{
+		Client:  client,
+		Request: req,
+		Scopes:  strings.Fields(req.Scope),
+	})
+}
+
+func (app *app) submitAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	req := newAuthorizationRequest(r.PostForm)
+
+	client := app.checkAuthorizationRequest(w, r, req)
+	if client == nil {
+		return
+	}
+
+	if !checkAuthorizeCSRF(r, req) {
+		app.renderAuthorizePage(w, r, http.StatusForbidden, &authorizePage{
+			Client:  client,
+			Request: req,
+			Scopes:  strings.Fields(req.Scope),
+			Error:   "Your sign in form has expired. Please try again.",
+		})
+		return
+	}
+
+	if r.PostForm.Get("decision") != "approve" {
+		app.redirectAuthorizationError(w, r, req, "access_denied", "the user denied the request")
+		return
+	}
+
+	page := &authorizePage{
+		Client:  client,
+		Request: req,
+		Scopes:  strings.Fields(req.Scope),
+		Email:   r.PostForm.Get("email"),
+	}
+
+	var user *data.User
+	if mfaToken := r.PostForm.Get("mfa_token"); mfaToken != "" {
+		user = app.authorizeSecondFactor(w, r, page, mfaToken)
+	} else {
+		user = app.authorizePassword(w, r, page)
+	}
+	if user == nil {
+		return
+	}
+
+	code, err := app.models.Tokens.NewAuthorizationCode(user.ID, client.ID,
+		authorizationCodeTTL, data.AuthorizationRequest{
+			RedirectURI:   req.RedirectURI,
+			CodeChallenge: req.CodeChallenge,
+			OAuthScope:    req.Scope,
+			Nonce:         req.Nonce,
+		})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("OAuth authorization code issued", "user", user.Email,
+		"client", client.Name)
+
+	params := url.Values{"code": {code.Plaintext}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	http.Redirect(w, r, appendQuery(req.RedirectURI, params), http.StatusSeeOther)
+}
+
+// authorizePassword checks the email address and password submitted on the
+// sign in page and returns the user if they can be signed in. Users with
+// two-factor authentication enabled are instead shown the page again with a
+// pending MFA token, which allows one attempt at entering a code. If nil is
+// returned, the response has been sent.
+func (app *app) authorizePassword(w http.ResponseWriter, r *http.Request, page *authorizePage) *data.User {
+	password := r.PostForm.Get("password")
+
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, password)
+	if !v.Valid() {
+		page.Error = "Invalid email address or password."
+		app.renderAuthorizePage(w, r, http.StatusUnauthorized, page)
+		return nil
+	}
+
+	user, err := app.models.Users.GetByIdentifier("email", page.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.ServerErrorResponse(w, r, err)
+		return nil
+	}
+
+	meta := sessionMetadata(r, "")
+
+	// Sign in attempts made here count towards the same per account and per
+	// IP address limits as those made through the API.
+	d, locked, err := app.loginDelay(user, meta.IP)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return nil
+	}
+
+	if d > 0 {
+		app.renderAuthorizeLoginDelayed(w, r, page, d, locked)
+		return nil
+	}
+
+	match := false
+	if user != nil {
+		match, err = user.Password.Matches(password, app.cfg.argon2)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return nil
+		}
+	}
+
+	if !match {
+		lockedFor, err := app.countLoginFailure(user, meta.IP)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return nil
+		}
+
+		if lockedFor > 0 {
+			app.renderAuthorizeLoginDelayed(w, r, page, lockedFor, true)
+			return nil
+		}
+
+		page.Error = "Invalid email address or password."
+		app.renderAuthorizePage(w, r, http.StatusUnauthorized, page)
+		return nil
+	}
+
+	err = app.resetLoginFailures(user)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return nil
+	}
+
+	if !user.CanSignIn() {
+		page.Error = "Your account must be activated and not suspended to sign in."
+		app.renderAuthorizePage(w, r, http.StatusForbidden, page)
+		return nil
+	}
+
+	app.rehashPassword(user, password)
+
+	enabled, err := app.models.MFA.IsEnabled(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return nil
+	}
+
+	if !enabled {
+		return user
+	}
+
+	token, err := app.models.Tokens.NewMFAPending(user.ID, mfaPendingTTL, meta)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return nil
+	}
+
+	page.MFAToken = token.Plaintext
+	app.renderAuthorizePage(w, r, http.StatusOK, page)
+	return nil
+}
+
+// authorizeSecondFactor checks the two-factor authentication code submitted on
+// the sign in page and returns the user if they can be signed in. The pending
+// MFA token is consumed first, so each password check allows only one
+// attempt at a code. If nil is returned, the response has been sent.
+func (app *app) authorizeSecondFactor(w http.ResponseWriter, r *http.Request, page *authorizePage, mfaToken string) *data.User {
+	code := r.PostForm.Get("code")
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, mfaToken)
+	data.ValidateMFACode(v, code)
+	if !v.Valid() {
+		page.Error = "Invalid authentication code. Please sign in again."
+		app.renderAuthorizePage(w, r, http.StatusUnauthorized, page)
+		return nil
+	}
+
+	pending, err := app.models.Tokens.Consume(data.ScopeMFAPending, mfaToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			page.Error = "Your sign in has expired. Please sign in again."
+			app.renderAuthorizePage(w, r, http.StatusUnauthorized, page)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	user, err := app.models.Users.GetByIdentifier("id", strconv.FormatInt(pending.UserID, 10))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			page.Error = "Your sign in has expired. Please sign in again."
+			app.renderAuthorizePage(w, r, http.StatusUnauthorized, page)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	ok, err := app.verifySecondFactor(user, code)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return nil
+	}
+
+	if !ok {
+		page.Error = "Invalid authentication code. Please sign in again."
+		app.renderAuthorizePage(w, r, http.StatusUnauthorized, page)
+		return nil
+	}
+
+	if !user.CanSignIn() {
+		page.Error = "Your account must be activated and not suspended to sign in."
+		app.renderAuthorizePage(w, r, http.StatusForbidden, page)
+		return nil
+	}
+
+	return user
+}
+
+// verifyCodeChallenge reports whether verifier is the PKCE code verifier for
+// the given S256 code challenge (RFC 7636 section 4.6).
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if !validator.Matches(verifier, pkceRX) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// authenticatePublicOrConfidentialClient authenticates the client making a
+// token request. Confidential clients must use HTTP Basic authentication,
+// whereas public clients such as mobile apps, which cannot keep a secret, may
+// instead only identify themselves with the client_id parameter and rely on
+// PKCE.
+func (app *app) authenticatePublicOrConfidentialClient(w http.ResponseWriter, r *http.Request) *data.Service {
+	if _, _, ok := r.BasicAuth(); ok {
+		return app.authenticateClient(w, r)
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	if clientID == "" {
+		app.oauthErrorResponse(w, http.StatusUnauthorized, oauthErrInvalidClient,
+			"client authentication is required")
+		return nil
+	}
+
+	client, err := app.models.Services.GetByName(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, http.StatusUnauthorized, oauthErrInvalidClient,
+				"invalid client credentials")
+		default:
+			app.oauthServerErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	switch {
+	case client.Suspended:
+		app.oauthErrorResponse(w, http.StatusUnauthorized, oauthErrInvalidClient,
+			"invalid client credentials")
+		return nil
+	case !client.Public:
+		app.oauthErrorResponse(w, http.StatusUnauthorized, oauthErrInvalidClient,
+			"client authentication is required")
+		return nil
+	}
+
+	return client
+}
+
+// authorizationCodeGrant exchanges an authorization code for an access token
+// as described in RFC 6749 section 4.1.3, verifying the PKCE code verifier
+// against the challenge from the authorization request.
+func (app *app) authorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
+	client := app.authenticatePublicOrConfidentialClient(w, r)
+	if client == nil {
+		return
+	}
+
+	codePlaintext := r.PostForm.Get("code")
+	redirectURI := r.PostForm.Get("redirect_uri")
+	verifier := r.PostForm.Get("code_verifier")
+
+	if codePlaintext == "" || verifier == "" {
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidRequest,
+			"code and code_verifier must be provided")
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, codePlaintext)
+	if !v.Valid() {
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidGrant,
+			"invalid authorization code")
+		return
+	}
+
+	// The code is consumed before it is checked so that it can never be
+	// used twice, even if the first attempt fails.
+	code, err := app.models.Tokens.Consume(data.ScopeAuthorizationCode, codePlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidGrant,
+				"invalid or expired authorization code")
+		default:
+			app.oauthServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	switch {
+	case code.ClientID != client.ID:
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidGrant,
+			"the authorization code was issued to another client")
+		return
+	case code.RedirectURI != redirectURI:
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidGrant,
+			"redirect_uri does not match the authorization request")
+		return
+	case !verifyCodeChallenge(verifier, code.CodeChallenge):
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidGrant,
+			"invalid code_verifier")
+		return
+	}
+
+	user, err := app.models.Users.GetByIdentifier("id", strconv.FormatInt(code.UserID, 10))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidGrant,
+				"the user no longer exists")
+		default:
+			app.oauthServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated || user.Suspended {
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidGrant,
+			"the user account is not active")
+		return
+	}
+
+	token, err := app.models.Tokens.NewForClient(user.ID, client.ID, oauthAccessTokenTTL,
+		data.ScopeAuthentication, code.OAuthScope, sessionMetadata(r, ""))
+	if err != nil {
+		app.oauthServerErrorResponse(w, r, err)
+		return
+	}
+
+	response := oauthTokenResponse{
+		AccessToken: token.Plaintext,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oauthAccessTokenTTL.Seconds()),
+		Scope:       code.OAuthScope,
+	}
+
+	// An ID token is only issued for OpenID Connect authentication requests.
+	scopes := strings.Fields(code.OAuthScope)
+	if slices.Contains(scopes, scopeOpenID) {
+		response.IDToken, err = app.newIDToken(user, client, code.Nonce, scopes)
+		if err != nil {
+			app.oauthServerErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.Logger.Info("OAuth authorization code exchanged", "user", user.Email,
+		"client", client.Name)
+
+	app.writeOAuthJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// The challenge is BASE64URL(SHA256(verifier)) without padding.
+	verifier := "dBjftJeZ4CVP-mJ92IqSDgdHddBLQm5DdZ7YcIyxwbY"
+	challenge := "laTB4XVNOSlHUK7mkojPY-UPkztebBy8JT6HlRGyvzI"
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		want      bool
+	}{
+		{"Valid", verifier, challenge, true},
+		{"Wrong verifier", strings.Replace(verifier, "d", "e", 1), challenge, false},
+		{"Wrong challenge", verifier, strings.Replace(challenge, "l", "m", 1), false},
+		{"Plain challenge", verifier, verifier, false},
+		{"Short verifier", verifier[:42], challenge, false},
+		{"Long verifier", strings.Repeat("a", 129), challenge, false},
+		{"Invalid characters", verifier[:42] + "+", challenge, false},
+		{"Empty", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifyCodeChallenge(tt.verifier, tt.challenge)
+			if got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendQuery(t *testing.T) {
+	params := url.Values{"code": {"abc"}, "state": {"x y"}}
+
+	tests := []struct {
+		name string
+		uri  string
+		want string
+	}{
+		{"No query", "https://app.example.com/cb", "https://app.example.com/cb?code=abc&state=x+y"},
+		{"Existing query", "https://app.example.com/cb?tab=1", "https://app.example.com/cb?code=abc&state=x+y&tab=1"},
+		{"Replaced parameter", "https://app.example.com/cb?code=old", "https://app.example.com/cb?code=abc&state=x+y"},
+		{"Custom scheme", "com.example.app:/cb", "com.example.app:/cb?code=abc&state=x+y"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := appendQuery(tt.uri, params)
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAuthorizeCSRF(t *testing.T) {
+	req := &authorizationRequest{
+		ResponseType:        "code",
+		ClientID:            "webapp",
+		RedirectURI:         "https://webapp.example.com/callback",
+		State:               "xyz",
+		CodeChallenge:       "laTB4XVNOSlHUK7mkojPY-UPkztebBy8JT6HlRGyvzI",
+		CodeChallengeMethod: "S256",
+	}
+
+	rr := httptest.NewRecorder()
+	secret, err := authorizeCSRFSecret(rr, httptest.NewRequest(http.MethodGet, "/oauth/authorize", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != secret || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("got cookies %+v", cookies)
+	}
+
+	otherState := *req
+	otherState.State = "abc"
+
+	tests := []struct {
+		name   string
+		cookie string
+		token  string
+		want   bool
+	}{
+		{"Valid", secret, authorizeCSRFToken(secret, req), true},
+		{"No cookie", "", authorizeCSRFToken(secret, req), false},
+		{"No token", secret, "", false},
+		{"Other cookie", strings.Repeat("a", 43), authorizeCSRFToken(secret, req), false},
+		{"Other request", secret, authorizeCSRFToken(secret, &otherState), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"csrf_token": {tt.token}}
+			r := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: authorizeCSRFCookie, Value: tt.cookie})
+			}
+
+			err := r.ParseForm()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := checkAuthorizeCSRF(r, req)
+			if got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeCSRF(t *testing.T) {
+	app := newTestDBApplication(t)
+	insertTestService(t, app, "webapp")
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"webapp"},
+		"redirect_uri":          {"https://webapp.example.com/callback"},
+		"state":                 {"xyz"},
+		"code_challenge":        {"laTB4XVNOSlHUK7mkojPY-UPkztebBy8JT6HlRGyvzI"},
+		"code_challenge_method": {"S256"},
+	}
+
+	rr := serve(app.showAuthorizeHandler, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+query.Encode(), nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+
+	if got := rr.Header().Get("Content-Security-Policy"); got != "frame-ancestors 'none'" {
+		t.Errorf("got Content-Security-Policy %q", got)
+	}
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != authorizeCSRFCookie {
+		t.Fatalf("got cookies %+v", cookies)
+	}
+
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(rr.Body.String())
+	if match == nil {
+		t.Fatal("page has no CSRF token")
+	}
+
+	submit := func(form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return serve(app.submitAuthorizeHandler, r)
+	}
+
+	form := url.Values{"decision": {"deny"}, "csrf_token": {match[1]}}
+	for key, values := range query {
+		form[key] = values
+	}
+
+	// A form posted by another site does not come with the cookie.
+	rr = submit(form, nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d without the cookie; want %d", rr.Code, http.StatusForbidden)
+	}
+
+	// The token only covers the request that the page was shown for.
+	changed := url.Values{}
+	for key, values := range form {
+		changed[key] = values
+	}
+	changed.Set("state", "abc")
+
+	rr = submit(changed, cookies[0])
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d for another request; want %d", rr.Code, http.StatusForbidden)
+	}
+
+	rr = submit(form, cookies[0])
+	if rr.Code != http.StatusFound || !strings.Contains(rr.Header().Get("Location"), "error=access_denied") {
+		t.Errorf("got status %d with location %q; want the denial to be sent to the client", rr.Code, rr.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// oauthIntrospectionResponse is a token introspection response as described in
+// RFC 7662 section 2.2. Inactive tokens are reported with only the Active
+// member.
+type oauthIntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// oauthIntrospectHandler reports whether a token is active, and if so, who it
+// belongs to, as described in RFC 7662. The caller must authenticate as a
+// registered service.
+func (app *app) oauthIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidRequest,
+			"the request body must be form encoded")
+		return
+	}
+
+	if app.authenticateClient(w, r) == nil {
+		return
+	}
+
+	tokenPlaintext := r.PostForm.Get("token")
+	if tokenPlaintext == "" {
+		app.oauthErrorResponse(w, http.StatusBadRequest, oauthErrInvalidRequest,
+			"token must be provided")
+		return
+	}
+
+	// The token_type_hint parameter is ignored, since tokens of every type
+	// are looked up in the same way.
+	var response *oauthIntrospectionResponse
+
+	if data.IsJWT(tokenPlaintext) {
+		response, err = app.introspectJWT(tokenPlaintext)
+	} else {
+		response, err = app.introspectOpaqueToken(tokenPlaintext)
+	}
+
+	if err != nil {
+		app.oauthServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeOAuthJSON(w, http.StatusOK, response)
+}
+
+// introspectOpaqueToken describes a token stored in the tokens table.
+func (app *app) introspectOpaqueToken(tokenPlaintext string) (*oauthIntrospectionResponse, error) {
+	info, err := app.models.Tokens.Introspect(tokenPlaintext)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return &oauthIntrospectionResponse{Active: false}, nil
+		}
+		return nil, err
+	}
+
+	// Only access and refresh tokens are ever reported as active, so the
+	// token type is one of the types defined by RFC 6749.
+	tokenType := "Bearer"
+	if info.Scope == data.ScopeRefresh {
+		tokenType = "refresh_token"
+	}
+
+	response := &oauthIntrospectionResponse{
+		Active:    true,
+		Subject:   info.Subject,
+		Scope:     info.OAuthScope,
+		ExpiresAt: info.Expiry.Unix(),
+		IssuedAt:  info.CreatedAt.Unix(),
+		ClientID:  info.Client,
+		TokenType: tokenType,
+	}
+
+	return response, nil
+}
+
+// introspectJWT describes a JWT access token, which is active if its
+// signature verifies and its owner has not been suspended or deleted.
+func (app *app) introspectJWT(tokenPlaintext string) (*oauthIntrospectionResponse, error) {
+	claims, err := app.keys.ParseAccessToken(app.cfg.oidc.issuer, tokenPlaintext)
+	if err != nil {
+		return &oauthIntrospectionResponse{Active: false}, nil
+	}
+
+	user, err := app.models.Users.GetByIdentifier("user_id", claims.Subject)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return &oauthIntrospectionResponse{Active: false}, nil
+		}
+		return nil, err
+	}
+
+	if user.Suspended {
+		return &oauthIntrospectionResponse{Active: false}, nil
+	}
+
+	response := &oauthIntrospectionResponse{
+		Active:    true,
+		Subject:   claims.Subject,
+		Scope:     claims.Scope,
+		ExpiresAt: claims.ExpiresAt.Unix(),
+		TokenType: "Bearer",
+	}
+
+	if claims.IssuedAt != nil {
+		response.IssuedAt = claims.IssuedAt.Unix()
+	}
+
+	return response, nil
+}
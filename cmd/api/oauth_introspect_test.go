@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestOAuthIntrospectHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+	client, _ := insertTestService(t, app, "photo-app")
+	gateway, gatewaySecret := insertTestService(t, app, "api-gateway")
+	meta := data.SessionMetadata{IP: "192.0.2.1"}
+
+	access, err := app.models.Tokens.NewForClient(user.ID, client.ID, time.Hour, data.ScopeAuthentication,
+		"openid users:read", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh, err := app.models.Tokens.NewInFamily(user.ID, time.Hour, data.ScopeRefresh, nil, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfaPending, err := app.models.Tokens.NewMFAPending(user.ID, time.Hour, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  oauthIntrospectionResponse
+	}{
+		{"Access token", access.Plaintext, oauthIntrospectionResponse{
+			Active:    true,
+			Subject:   user.UserID,
+			Scope:     "openid users:read",
+			ClientID:  client.Name,
+			TokenType: "Bearer",
+		}},
+		{"Refresh token", refresh.Plaintext, oauthIntrospectionResponse{
+			Active:    true,
+			Subject:   user.UserID,
+			TokenType: "refresh_token",
+		}},
+		{"Pending two-factor token", mfaPending.Plaintext, oauthIntrospectionResponse{}},
+		{"Password reset token", reset.Plaintext, oauthIntrospectionResponse{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"token": {tt.token}}
+			r := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth(gateway.Name, gatewaySecret)
+
+			rr := serve(app.oauthIntrospectHandler, r)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+			}
+
+			var got oauthIntrospectionResponse
+			err := json.NewDecoder(rr.Body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Timestamps are only checked for being present.
+			if got.Active && (got.ExpiresAt == 0 || got.IssuedAt == 0) {
+				t.Errorf("got exp %d and iat %d", got.ExpiresAt, got.IssuedAt)
+			}
+			got.ExpiresAt, got.IssuedAt = 0, 0
+
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClientCredentialsGrant(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	service, secret := insertTestService(t, app, "widgets")
+
+	err := app.models.Permissions.InsertForService(service.ID, "widgets:read", "widgets:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grant := func(scope string) *httptest.ResponseRecorder {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(service.Name, secret)
+		return serve(app.oauthTokenHandler, r)
+	}
+
+	rr := grant("widgets:read users:read")
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "invalid_scope") {
+		t.Errorf("got status %d: %s; want invalid_scope", rr.Code, rr.Body)
+	}
+
+	tests := []struct {
+		name      string
+		scope     string
+		wantScope string
+	}{
+		{"No scope", "", "widgets:read widgets:write"},
+		{"Narrower scope", "widgets:read", "widgets:read"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := grant(tt.scope)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+			}
+
+			var res oauthTokenResponse
+			err := json.NewDecoder(rr.Body).Decode(&res)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Scope != tt.wantScope {
+				t.Errorf("got scope %q; want %q", res.Scope, tt.wantScope)
+			}
+
+			// The token can only be used for the permissions in its scope.
+			for _, code := range []string{"widgets:read", "widgets:write"} {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("Authorization", "Bearer "+res.AccessToken)
+
+				rr := httptest.NewRecorder()
+				app.authenticate(app.requirePermission(code, okHandler)).ServeHTTP(rr, r)
+
+				want := http.StatusForbidden
+				if strings.Contains(" "+tt.wantScope+" ", " "+code+" ") {
+					want = http.StatusOK
+				}
+				if rr.Code != want {
+					t.Errorf("got status %d using %s; want %d", rr.Code, code, want)
+				}
+			}
+		})
+	}
+}
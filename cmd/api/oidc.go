@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/m5lapp/go-user-service/internal/data"
+	"golang.org/x/exp/slices"
+)
+
+// OpenID Connect scopes that control which claims are released about a user.
+const (
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+)
+
+// userClaims holds the standard OpenID Connect claims (OpenID Connect Core
+// section 5.1) that can be released about a user.
+type userClaims struct {
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Nickname      string `json:"nickname,omitempty"`
+	ZoneInfo      string `json:"zoneinfo,omitempty"`
+	BirthDate     string `json:"birthdate,omitempty"`
+	Gender        string `json:"gender,omitempty"`
+}
+
+// newUserClaims maps the fields of user onto the OpenID Connect claims that
+// are permitted by the given scopes.
+func newUserClaims(user *data.User, scopes []string) userClaims {
+	var claims userClaims
+
+	for _, scope := range scopes {
+		switch scope {
+		case scopeEmail:
+			verified := user.Activated
+			claims.Email = user.Email
+			claims.EmailVerified = &verified
+		case scopeProfile:
+			claims.Name = user.Name
+			if user.FriendlyName != nil {
+				claims.Nickname = *user.FriendlyName
+			}
+			if user.TimeZone != nil {
+				claims.ZoneInfo = *user.TimeZone
+			}
+			if user.BirthDate != nil {
+				claims.BirthDate = user.BirthDate.Format(time.DateOnly)
+			}
+			if user.Gender != nil {
+				claims.Gender = *user.Gender
+			}
+		}
+	}
+
+	return claims
+}
+
+// idTokenClaims are the claims of an OpenID Connect ID token (OpenID Connect
+// Core section 2).
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce string `json:"nonce,omitempty"`
+	userClaims
+}
+
+// newIDToken creates a signed ID token asserting that user has authenticated
+// to client.
+func (app *app) newIDToken(user *data.User, client *data.Service, nonce string, scopes []string) (string, error) {
+	now := time.Now()
+
+	claims := idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    app.cfg.oidc.issuer,
+			Subject:   user.UserID,
+			Audience:  jwt.ClaimStrings{client.Name},
+			ExpiresAt: jwt.NewNumericDate(now.Add(oauthAccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Nonce:      nonce,
+		userClaims: newUserClaims(user, scopes),
+	}
+
+	return app.keys.Current().Sign(claims)
+}
+
+func (app *app) openIDConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	issuer := strings.TrimSuffix(app.cfg.oidc.issuer, "/")
+
+	// See OpenID Connect Discovery section 3.
+	metadata := map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"revocation_endpoint":                   issuer + "/oauth/revoke",
+		"introspection_endpoint":                issuer + "/oauth/introspect",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"scopes_supported":                      []string{scopeOpenID, scopeProfile, scopeEmail},
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{app.keys.Current().Algorithm},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "nonce", "email", "email_verified",
+			"name", "nickname", "zoneinfo", "birthdate", "gender",
+		},
+	}
+
+	app.writeBareJSON(w, http.StatusOK, metadata)
+}
+
+func (app *app) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeBareJSON(w, http.StatusOK, app.keys.JWKSet())
+}
+
+func (app *app) userInfoHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// Tokens issued directly by this service rather than to an OAuth 2.0
+	// client belong to the user themselves, so every claim is released.
+	scopes := []string{scopeOpenID, scopeProfile, scopeEmail}
+
+	if granted, ok := app.contextGetOAuthScope(r); ok {
+		scopes = granted
+
+		if !slices.Contains(scopes, scopeOpenID) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			app.oauthErrorResponse(w, http.StatusForbidden, "insufficient_scope",
+				"the access token was not granted the openid scope")
+			return
+		}
+	}
+
+	app.writeUserInfo(w, user, scopes)
+}
+
+// writeUserInfo sends the claims about user permitted by scopes in the
+// OpenID Connect UserInfo response format.
+func (app *app) writeUserInfo(w http.ResponseWriter, user *data.User, scopes []string) {
+	response := struct {
+		Subject string `json:"sub"`
+		userClaims
+	}{
+		Subject:    user.UserID,
+		userClaims: newUserClaims(user, scopes),
+	}
+
+	app.writeBareJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/m5lapp/go-user-service/internal/data"
+	"golang.org/x/exp/slices"
+)
+
+// oidcClient is a minimal OpenID Connect relying party, which discovers the
+// provider's metadata and verifies ID tokens against its published keys.
+type oidcClient struct {
+	t        *testing.T
+	issuer   string
+	clientID string
+}
+
+// getJSON fetches url and decodes the JSON response into dst.
+func (c *oidcClient) getJSON(url string, dst any) {
+	c.t.Helper()
+
+	res, err := http.Get(url)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		c.t.Fatalf("GET %s: got status %d", url, res.StatusCode)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(dst)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// keys fetches the provider's published signing keys, discovering where they
+// are published from its metadata.
+func (c *oidcClient) keys() map[string]ed25519.PublicKey {
+	c.t.Helper()
+
+	var metadata struct {
+		Issuer           string   `json:"issuer"`
+		JWKSURI          string   `json:"jwks_uri"`
+		SigningAlgValues []string `json:"id_token_signing_alg_values_supported"`
+	}
+	c.getJSON(c.issuer+"/.well-known/openid-configuration", &metadata)
+
+	if metadata.Issuer != c.issuer {
+		c.t.Fatalf("got issuer %q; want %q", metadata.Issuer, c.issuer)
+	}
+	if !slices.Contains(metadata.SigningAlgValues, data.AlgorithmEdDSA) {
+		c.t.Fatalf("got signing algorithms %v; want %s", metadata.SigningAlgValues, data.AlgorithmEdDSA)
+	}
+
+	var set data.JWKSet
+	c.getJSON(metadata.JWKSURI, &set)
+
+	keys := map[string]ed25519.PublicKey{}
+	for _, jwk := range set.Keys {
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || jwk.KeyType != "OKP" || jwk.Thumbprint() != jwk.KeyID {
+			c.t.Fatalf("invalid JWK %+v", jwk)
+		}
+		keys[jwk.KeyID] = ed25519.PublicKey(x)
+	}
+
+	return keys
+}
+
+// verify checks the signature, issuer, audience and expiry of an ID token
+// using the given keys and returns its claims.
+func (c *oidcClient) verify(keys map[string]ed25519.PublicKey, idToken string) (*idTokenClaims, error) {
+	var claims idTokenClaims
+
+	_, err := jwt.ParseWithClaims(idToken, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := keys[kid]
+		if !ok {
+			return nil, errors.New("unknown kid")
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{data.AlgorithmEdDSA}),
+		jwt.WithIssuer(c.issuer),
+		jwt.WithAudience(c.clientID),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+func TestOpenIDConnectClient(t *testing.T) {
+	app := newTestApplication(t)
+
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	app.cfg.oidc.issuer = srv.URL
+
+	client := &oidcClient{t: t, issuer: srv.URL, clientID: "photo-app"}
+	user := &data.User{UserID: "a1b2c3d4e5f6a7b8", Email: "alice@example.com", Name: "Alice", Activated: true}
+
+	idToken, err := app.newIDToken(user, &data.Service{Name: client.clientID}, "n-0S6_WzA2Mj",
+		[]string{scopeOpenID, scopeEmail})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := client.keys()
+
+	claims, err := client.verify(keys, idToken)
+	if err != nil {
+		t.Fatalf("verifying ID token: %s", err)
+	}
+
+	switch {
+	case claims.Subject != user.UserID:
+		t.Errorf("got sub %q; want %q", claims.Subject, user.UserID)
+	case claims.Nonce != "n-0S6_WzA2Mj":
+		t.Errorf("got nonce %q; want %q", claims.Nonce, "n-0S6_WzA2Mj")
+	case claims.Email != user.Email || claims.EmailVerified == nil || !*claims.EmailVerified:
+		t.Errorf("got email %q verified %v; want %q verified", claims.Email, claims.EmailVerified, user.Email)
+	case claims.Name != "":
+		t.Errorf("got name %q without the profile scope", claims.Name)
+	}
+
+	other := &oidcClient{t: t, issuer: srv.URL, clientID: "other-app"}
+	if _, err := other.verify(keys, idToken); err == nil {
+		t.Error("ID token verified for another client")
+	}
+
+	// The next signing key is published before it is used, so clients that
+	// cached the key set can verify tokens signed after a rotation, and
+	// tokens signed before it still verify.
+	_, err = app.keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := app.newIDToken(user, &data.Service{Name: client.clientID}, "", []string{scopeOpenID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.verify(keys, rotated); err != nil {
+		t.Errorf("verifying ID token signed after rotation with cached keys: %s", err)
+	}
+
+	if _, err := client.verify(client.keys(), idToken); err != nil {
+		t.Errorf("verifying ID token signed before rotation: %s", err)
+	}
+
+	// An emergency rotation stops every previously issued token verifying.
+	_, err = app.keys.EmergencyRotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.verify(client.keys(), rotated); err == nil {
+		t.Error("ID token verified after emergency rotation")
+	}
+}
+
+func TestUserInfoHandler(t *testing.T) {
+	app := newTestApplication(t)
+	user := &data.User{UserID: "a1b2c3d4e5f6a7b8", Email: "alice@example.com", Name: "Alice", Activated: true}
+
+	tests := []struct {
+		name       string
+		oauthScope []string
+		wantCode   int
+		wantEmail  string
+		wantName   string
+	}{
+		{"User token", nil, http.StatusOK, user.Email, user.Name},
+		{"Client token with email scope", []string{scopeOpenID, scopeEmail}, http.StatusOK, user.Email, ""},
+		{"Client token with profile scope", []string{scopeOpenID, scopeProfile}, http.StatusOK, "", user.Name},
+		{"Client token without openid scope", []string{scopeEmail, "users:read"}, http.StatusForbidden, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+			r = app.contextSetUser(r, user)
+			if tt.oauthScope != nil {
+				r = app.contextSetOAuthScope(r, tt.oauthScope)
+			}
+
+			rr := serve(app.userInfoHandler, r)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.wantCode)
+			}
+
+			if rr.Code != http.StatusOK {
+				if rr.Header().Get("WWW-Authenticate") == "" {
+					t.Error("missing WWW-Authenticate header")
+				}
+				return
+			}
+
+			var claims struct {
+				Subject string `json:"sub"`
+				Email   string `json:"email"`
+				Name    string `json:"name"`
+			}
+
+			err := json.NewDecoder(rr.Body).Decode(&claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Subject != user.UserID || claims.Email != tt.wantEmail || claims.Name != tt.wantName {
+				t.Errorf("got %+v; want sub %q, email %q and name %q", claims, user.UserID,
+					tt.wantEmail, tt.wantName)
+			}
+		})
+	}
+}
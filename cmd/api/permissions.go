@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// userForIDParam retrieves the user identified by the "value" URL parameter.
+// If the user cannot be retrieved, an appropriate response is sent and nil is
+// returned.
+func (app *app) userForIDParam(w http.ResponseWriter, r *http.Request) *data.User {
+	params := httprouter.ParamsFromContext(r.Context())
+	value := params.ByName("value")
+
+	v := validator.New()
+	v.Check(validator.Matches(value, validator.BetterGUIDRX),
+		"user-id", "must be a valid BetterGUID")
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return nil
+	}
+
+	user, err := app.models.Users.GetByIdentifier("user_id", value)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return user
+}
+
+// validatePermissionCodes checks that codes is non-empty and only contains
+// codes that exist in the permissions table. Any violations are added to the
+// given validator.Validator under the "permissions" key.
+func (app *app) validatePermissionCodes(v *validator.Validator, codes []string) error {
+	services, err := app.models.Permissions.ListAll()
+	if err != nil {
+		return err
+	}
+
+	var known data.Permissions
+	for _, service := range services {
+		known = append(known, service.Permissions...)
+	}
+
+	v.Check(len(codes) > 0, "permissions", "must contain at least one code")
+	for _, code := range codes {
+		v.Check(known.Include(code), "permissions", "must only contain known permission codes")
+	}
+
+	return nil
+}
+
+func (app *app) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	services, err := app.models.Permissions.ListAll()
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"services": services})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) listUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.userForIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"permissions": permissions})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) addUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.userForIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	err = app.validatePermissionCodes(v, input.Permissions)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, input.Permissions...)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("Permissions granted to user", "user", user.Email,
+		"permissions", input.Permissions)
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"permissions": permissions})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) removeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.userForIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	err := app.models.Permissions.RemoveForUser(user.ID, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("Permission revoked from user", "user", user.Email, "permission", code)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestUserPermissionHandlers(t *testing.T) {
+	app := newTestDBApplication(t)
+	routes := app.routes()
+
+	admin := insertTestUser(t, app, "admin@example.com", "correct horse battery staple")
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+
+	err := app.models.Permissions.AddForUser(admin.ID, "permissions:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Tokens.New(admin.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, r)
+		return rr
+	}
+
+	path := "/v1/user/id/" + user.UserID + "/permissions"
+
+	listPermissions := func() data.Permissions {
+		rr := send(http.MethodGet, path, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d listing permissions: %s", rr.Code, rr.Body)
+		}
+
+		var res struct {
+			Data struct {
+				Permissions data.Permissions `json:"permissions"`
+			} `json:"data"`
+		}
+
+		err := json.NewDecoder(rr.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res.Data.Permissions
+	}
+
+	if permissions := listPermissions(); len(permissions) != 0 {
+		t.Errorf("got permissions %v; want none", permissions)
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"No codes", `{"permissions": []}`, http.StatusUnprocessableEntity},
+		{"Unknown code", `{"permissions": ["users:read", "unknown:code"]}`, http.StatusUnprocessableEntity},
+		{"Known codes", `{"permissions": ["users:read", "users:write"]}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := send(http.MethodPost, path, tt.body)
+			if rr.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d: %s", rr.Code, tt.wantCode, rr.Body)
+			}
+		})
+	}
+
+	permissions := listPermissions()
+	if len(permissions) != 2 || !permissions.Include("users:read") || !permissions.Include("users:write") {
+		t.Errorf("got permissions %v; want users:read and users:write", permissions)
+	}
+
+	rr := send(http.MethodDelete, path+"/users:write", "")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d revoking a permission: %s", rr.Code, rr.Body)
+	}
+
+	rr = send(http.MethodDelete, path+"/users:write", "")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d revoking a permission that is not held; want %d", rr.Code, http.StatusNotFound)
+	}
+
+	permissions = listPermissions()
+	if len(permissions) != 1 || !permissions.Include("users:read") {
+		t.Errorf("got permissions %v; want only users:read", permissions)
+	}
+
+	rr = send(http.MethodGet, "/v1/user/id/not-a-guid/permissions", "")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for a malformed user ID; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
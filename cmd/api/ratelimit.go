@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/ratelimit"
+)
+
+// maxRateLimitBodyBytes is how much of a request body is read to find the
+// email address that it targets.
+const maxRateLimitBodyBytes = 1_048_576
+
+// rateLimitRule limits the requests to a route that share a key. Requests for
+// which key returns an empty string are not limited by the rule.
+type rateLimitRule struct {
+	name  string
+	limit ratelimit.Limit
+	key   func(r *http.Request) string
+}
+
+// perIP limits requests from each client IP address.
+func perIP(requests int, period time.Duration) rateLimitRule {
+	return rateLimitRule{
+		name:  "ip",
+		limit: ratelimit.Limit{Requests: requests, Period: period},
+		key:   clientIP,
+	}
+}
+
+// perEmail limits requests whose JSON or form body targets each email
+// address.
+func perEmail(requests int, period time.Duration) rateLimitRule {
+	return rateLimitRule{
+		name:  "email",
+		limit: ratelimit.Limit{Requests: requests, Period: period},
+		key:   requestEmail,
+	}
+}
+
+// requestEmail returns the normalised "email" field of a request's JSON or
+// form body, or an empty string if it has none. A JSON body is restored so
+// that it can still be read by the handler, while a parsed form is kept in
+// r.PostForm.
+func requestEmail(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		r.Body = http.MaxBytesReader(nil, r.Body, maxRateLimitBodyBytes)
+		return strings.ToLower(strings.TrimSpace(r.PostFormValue("email")))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRateLimitBodyBytes))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return ""
+	}
+
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	if json.Unmarshal(body, &input) != nil {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(input.Email))
+}
+
+// rateLimit rejects requests to the named route once any of the given rules'
+// limits has been reached. Responses describe the limit closest to being
+// reached in RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+// If the limiter's store fails, requests are allowed rather than taking the
+// route down with it.
+func (app *app) rateLimit(route string, next http.HandlerFunc, rules ...rateLimitRule) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var tightest *ratelimit.Result
+
+		for _, rule := range rules {
+			value := rule.key(r)
+			if value == "" {
+				continue
+			}
+
+			result, err := app.limiter.Allow(route+":"+rule.name+":"+value, rule.limit)
+			if err != nil {
+				app.Logger.Error("Rate limiter failed", "error", err.Error(), "route", route)
+				continue
+			}
+
+			if tightest == nil || result.Tighter(*tightest) {
+				tightest = &result
+			}
+
+			if !result.Allowed {
+				break
+			}
+		}
+
+		if tightest == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(tightest.Reset.Seconds()))))
+
+		if !tightest.Allowed {
+			setRetryAfter(w, tightest.RetryAfter)
+			app.RateLimitExceededResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	app.limiter = ratelimit.NewMemoryStore()
+
+	next := func(w http.ResponseWriter, r *http.Request) {
+		// The body must still be readable once the email has been found.
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}
+	h := app.rateLimit("login", next, perIP(5, time.Minute), perEmail(2, time.Minute))
+
+	send := func(ip, email string) *httptest.ResponseRecorder {
+		body := `{"email": "` + email + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", strings.NewReader(body))
+		r.RemoteAddr = ip + ":51234"
+		rr := serve(h, r)
+		if rr.Code == http.StatusOK && rr.Body.String() != body {
+			t.Errorf("got body %q; want %q", rr.Body, body)
+		}
+		return rr
+	}
+
+	rr := send("192.0.2.1", "alice@example.com")
+	if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != "1" {
+		t.Fatalf("got status %d with headers %v; want the email limit reported", rr.Code, rr.Header())
+	}
+
+	// Emails are normalised, so changing their case does not get around the
+	// limit.
+	send("192.0.2.2", "Alice@Example.com")
+
+	rr = send("192.0.2.3", "alice@example.com ")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d with headers %v; want 429 with Retry-After", rr.Code, rr.Header())
+	}
+
+	// The per IP limit applies across email addresses.
+	for i := 0; i < 4; i++ {
+		send("192.0.2.1", fmt.Sprintf("user%d@example.com", i))
+	}
+
+	rr = send("192.0.2.1", "bob@example.com")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("RateLimit-Limit") != "5" {
+		t.Errorf("got status %d with headers %v; want 429 for the IP limit", rr.Code, rr.Header())
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// roleForIDParam retrieves the role identified by the "id" URL parameter. If
+// the role cannot be retrieved, an appropriate response is sent and nil is
+// returned.
+func (app *app) roleForIDParam(w http.ResponseWriter, r *http.Request) *data.Role {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		app.NotFoundResponse(w, r)
+		return nil
+	}
+
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return role
+}
+
+func (app *app) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"roles": roles})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+	}
+
+	v := validator.New()
+	data.ValidateRole(v, role)
+
+	if input.Permissions != nil {
+		err = app.validatePermissionCodes(v, input.Permissions)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.Insert(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if len(input.Permissions) > 0 {
+		err = app.models.Roles.AddPermissions(role.ID, input.Permissions...)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		role, err = app.models.Roles.Get(role.ID)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.Logger.Info("Role successfully created", "role", role.Name)
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusCreated, nil, jsonz.Envelope{"role": role})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) getRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.roleForIDParam(w, r)
+	if role == nil {
+		return
+	}
+
+	err := jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"role": role})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.roleForIDParam(w, r)
+	if role == nil {
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		role.Name = *input.Name
+	}
+	if input.Description != nil {
+		role.Description = input.Description
+	}
+
+	v := validator.New()
+	data.ValidateRole(v, role)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.Update(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.FailedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.EditConflictResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("Role successfully updated", "role", role.Name)
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"role": role})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.roleForIDParam(w, r)
+	if role == nil {
+		return
+	}
+
+	err := app.models.Roles.Delete(role.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("Role successfully deleted", "role", role.Name)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) addRolePermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.roleForIDParam(w, r)
+	if role == nil {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	err = app.validatePermissionCodes(v, input.Permissions)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.AddPermissions(role.ID, input.Permissions...)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	role, err = app.models.Roles.Get(role.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("Permissions granted to role", "role", role.Name,
+		"permissions", input.Permissions)
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"role": role})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) removeRolePermissionHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.roleForIDParam(w, r)
+	if role == nil {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	err := app.models.Roles.RemovePermission(role.ID, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("Permission revoked from role", "role", role.Name, "permission", code)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) listUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.userForIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"roles": roles})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) addUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.userForIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		RoleID int64 `json:"role_id"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	role, err := app.models.Roles.Get(input.RoleID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("role_id", "must be the ID of an existing role")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Roles.AddForUser(user.ID, role.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("Role assigned to user", "user", user.Email, "role", role.Name)
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"roles": roles})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.userForIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	role := app.roleForIDParam(w, r)
+	if role == nil {
+		return
+	}
+
+	err := app.models.Roles.RemoveForUser(user.ID, role.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("Role revoked from user", "user", user.Email, "role", role.Name)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
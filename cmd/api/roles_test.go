@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestRoleHandlers(t *testing.T) {
+	app := newTestDBApplication(t)
+	routes := app.routes()
+
+	admin := insertTestUser(t, app, "admin@example.com", "correct horse battery staple")
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+
+	err := app.models.Permissions.AddForUser(admin.ID, "permissions:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Tokens.New(admin.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := send(http.MethodPost, "/v1/role", `{"name": "Support", "permissions": ["users:read"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d creating a role: %s", rr.Code, rr.Body)
+	}
+
+	var res struct {
+		Data struct {
+			Role data.Role `json:"role"`
+		} `json:"data"`
+	}
+
+	err = json.NewDecoder(rr.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role := res.Data.Role
+	if role.Name != "Support" || len(role.Permissions) != 1 || role.Permissions[0] != "users:read" {
+		t.Errorf("got role %+v", role)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"Duplicate name", `{"name": "support"}`},
+		{"Unknown permission", `{"name": "Auditor", "permissions": ["unknown:code"]}`},
+		{"No name", `{"permissions": ["users:read"]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := send(http.MethodPost, "/v1/role", tt.body)
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+			}
+		})
+	}
+
+	path := "/v1/user/id/" + user.UserID + "/roles"
+
+	rr = send(http.MethodPost, path, `{"role_id": 0}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d assigning an unknown role; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	rr = send(http.MethodPost, path, `{"role_id": `+strconv.FormatInt(role.ID, 10)+`}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d assigning a role: %s", rr.Code, rr.Body)
+	}
+
+	// The user holds the role's permissions.
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !permissions.Include("users:read") {
+		t.Errorf("got permissions %v; want the role's users:read", permissions)
+	}
+
+	rolePath := path + "/" + strconv.FormatInt(role.ID, 10)
+
+	rr = send(http.MethodDelete, rolePath, "")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d revoking a role: %s", rr.Code, rr.Body)
+	}
+
+	rr = send(http.MethodDelete, rolePath, "")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d revoking a role that is not held; want %d", rr.Code, http.StatusNotFound)
+	}
+
+	permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 0 {
+		t.Errorf("got permissions %v after the role was revoked", permissions)
+	}
+}
@@ -1,16 +1,80 @@
 package main
 
-import "net/http"
+import (
+	"expvar"
+	"net/http"
+	"time"
+)
 
 func (app *app) routes() http.Handler {
-	app.Router.HandlerFunc(http.MethodDelete, "/v1/user", app.deleteUserHandler)
-	app.Router.HandlerFunc(http.MethodGet, "/v1/user/email/:value", app.getUserHandler)
-	app.Router.HandlerFunc(http.MethodGet, "/v1/user/id/:value", app.getUserHandler)
-	app.Router.HandlerFunc(http.MethodPost, "/v1/user", app.registerUserHandler)
-	app.Router.HandlerFunc(http.MethodPut, "/v1/user/activate", app.activateUserHandler)
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/user", app.requirePermission("users:write", app.deleteUserHandler))
+	app.Router.HandlerFunc(http.MethodGet, "/v1/user/email/:value", app.requirePermission("users:read", app.getUserHandler))
+	app.Router.HandlerFunc(http.MethodGet, "/v1/user/id/:value", app.requirePermission("users:read", app.getUserHandler))
+	app.Router.HandlerFunc(http.MethodPatch, "/v1/user", app.requireActivatedUser(app.updateUserHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user", app.rateLimit("register", app.registerUserHandler, perIP(10, time.Hour), perEmail(3, time.Hour)))
+	app.Router.HandlerFunc(http.MethodPut, "/v1/user/activate", app.rateLimit("activate", app.activateUserHandler, perIP(10, time.Minute)))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/activate/resend", app.rateLimit("resend", app.createActivationTokenHandler, perIP(10, time.Hour), perEmail(3, time.Hour)))
 	app.Router.HandlerFunc(http.MethodPost, "/v1/user/authenticate", app.authUserHandler)
+	app.Router.HandlerFunc(http.MethodPut, "/v1/user/password", app.updateUserPasswordHandler)
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/password-reset", app.rateLimit("password-reset", app.createPasswordResetTokenHandler, perIP(10, time.Hour), perEmail(3, time.Hour)))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/mfa/totp", app.requireActivatedUser(app.enrollTOTPHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/mfa/totp/confirm", app.requireActivatedUser(app.confirmTOTPHandler))
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/user/mfa/totp", app.rateLimit("mfa", app.requireActivatedUser(app.disableTOTPHandler), perIP(10, time.Minute)))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/webauthn/register", app.requireActivatedUser(app.beginWebAuthnRegistrationHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/webauthn/register/finish", app.requireActivatedUser(app.finishWebAuthnRegistrationHandler))
+	app.Router.HandlerFunc(http.MethodGet, "/v1/user/webauthn/credentials", app.requireActivatedUser(app.listWebAuthnCredentialsHandler))
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/user/webauthn/credentials/:id", app.requireActivatedUser(app.deleteWebAuthnCredentialHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/webauthn/login", app.rateLimit("webauthn-login", app.beginWebAuthnLoginHandler, perIP(20, time.Minute), perEmail(10, time.Minute)))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/webauthn/login/finish", app.rateLimit("webauthn-login-finish", app.finishWebAuthnLoginHandler, perIP(20, time.Minute)))
+	app.Router.HandlerFunc(http.MethodGet, "/v1/user/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/user/sessions/:id", app.requireAuthenticatedUser(app.deleteSessionHandler))
 
-	app.Router.HandlerFunc(http.MethodPost, "/v1/token", app.createAuthTokenHandler)
+	app.Router.HandlerFunc(http.MethodGet, "/v1/user/id/:value/permissions", app.requirePermission("permissions:write", app.listUserPermissionsHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/id/:value/permissions", app.requirePermission("permissions:write", app.addUserPermissionsHandler))
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/user/id/:value/permissions/:code", app.requirePermission("permissions:write", app.removeUserPermissionHandler))
 
-	return app.Metrics(app.RecoverPanic(app.Router))
+	app.Router.HandlerFunc(http.MethodGet, "/v1/user/id/:value/sessions", app.requirePermission("users:read", app.listUserSessionsHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/id/:value/unlock", app.requirePermission("users:write", app.unlockUserHandler))
+
+	app.Router.HandlerFunc(http.MethodGet, "/v1/user/id/:value/roles", app.requirePermission("permissions:write", app.listUserRolesHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/user/id/:value/roles", app.requirePermission("permissions:write", app.addUserRoleHandler))
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/user/id/:value/roles/:id", app.requirePermission("permissions:write", app.removeUserRoleHandler))
+
+	app.Router.HandlerFunc(http.MethodGet, "/v1/permissions", app.requirePermission("permissions:write", app.listPermissionsHandler))
+
+	app.Router.HandlerFunc(http.MethodGet, "/v1/roles", app.requirePermission("permissions:write", app.listRolesHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/role", app.requirePermission("permissions:write", app.createRoleHandler))
+	app.Router.HandlerFunc(http.MethodGet, "/v1/role/:id", app.requirePermission("permissions:write", app.getRoleHandler))
+	app.Router.HandlerFunc(http.MethodPatch, "/v1/role/:id", app.requirePermission("permissions:write", app.updateRoleHandler))
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/role/:id", app.requirePermission("permissions:write", app.deleteRoleHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/role/:id/permissions", app.requirePermission("permissions:write", app.addRolePermissionsHandler))
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/role/:id/permissions/:code", app.requirePermission("permissions:write", app.removeRolePermissionHandler))
+
+	app.Router.HandlerFunc(http.MethodPost, "/v1/service", app.requirePermission("services:write", app.registerServiceHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/service/token", app.rateLimit("service-token", app.createServiceTokenHandler, perIP(20, time.Minute)))
+
+	app.Router.HandlerFunc(http.MethodPost, "/v1/signing-key/rotate", app.requirePermission("keys:write", app.rotateSigningKeyHandler))
+
+	app.Router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("metrics:read", expvar.Handler().ServeHTTP))
+
+	app.Router.HandlerFunc(http.MethodPost, "/v1/token", app.rateLimit("login", app.createAuthTokenHandler, perIP(20, time.Minute), perEmail(10, time.Minute)))
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/token", app.deleteAuthTokenHandler)
+	app.Router.HandlerFunc(http.MethodDelete, "/v1/token/all", app.requireAuthenticatedUser(app.deleteAllAuthTokensHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/token/magic-link", app.rateLimit("magic-link", app.createMagicLinkTokenHandler, perIP(10, time.Hour), perEmail(5, time.Hour)))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/token/magic-link/redeem", app.rateLimit("magic-link-redeem", app.redeemMagicLinkTokenHandler, perIP(10, time.Minute)))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/token/mfa", app.rateLimit("mfa", app.createMFATokenHandler, perIP(10, time.Minute)))
+	app.Router.HandlerFunc(http.MethodPost, "/v1/token/refresh", app.refreshAuthTokenHandler)
+
+	app.Router.HandlerFunc(http.MethodGet, "/oauth/authorize", app.showAuthorizeHandler)
+	app.Router.HandlerFunc(http.MethodPost, "/oauth/authorize", app.rateLimit("login", app.submitAuthorizeHandler, perIP(20, time.Minute), perEmail(10, time.Minute)))
+	app.Router.HandlerFunc(http.MethodPost, "/oauth/token", app.rateLimit("oauth-token", app.oauthTokenHandler, perIP(60, time.Minute)))
+	app.Router.HandlerFunc(http.MethodPost, "/oauth/revoke", app.oauthRevokeHandler)
+	app.Router.HandlerFunc(http.MethodPost, "/oauth/introspect", app.oauthIntrospectHandler)
+
+	app.Router.HandlerFunc(http.MethodGet, "/.well-known/openid-configuration", app.openIDConfigurationHandler)
+	app.Router.HandlerFunc(http.MethodGet, "/.well-known/jwks.json", app.jwksHandler)
+	app.Router.HandlerFunc(http.MethodGet, "/userinfo", app.requireActivatedUserOrClient(app.userInfoHandler))
+	app.Router.HandlerFunc(http.MethodPost, "/userinfo", app.requireActivatedUserOrClient(app.userInfoHandler))
+
+	return app.Metrics(app.RecoverPanic(app.clientIP(app.authenticate(app.Router))))
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func (app *app) registerServiceHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		Description  *string  `json:"description"`
+		AdminEmail   *string  `json:"admin_email"`
+		Permissions  []string `json:"permissions"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Public       bool     `json:"public"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	service := &data.Service{
+		Name:         input.Name,
+		Description:  input.Description,
+		AdminEmail:   input.AdminEmail,
+		RedirectURIs: input.RedirectURIs,
+		Public:       input.Public,
+	}
+
+	secret, err := service.GenerateSecret(app.cfg.argon2)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateService(v, service)
+
+	// A service holds every permission it owns, so it must not be allowed to
+	// claim a code that already belongs to another service.
+	existing, err := app.models.Permissions.ListAll()
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	var taken data.Permissions
+	for _, s := range existing {
+		taken = append(taken, s.Permissions...)
+	}
+
+	for _, code := range input.Permissions {
+		v.Check(code != "", "permissions", "must not contain empty codes")
+		v.Check(!taken.Include(code), "permissions", "must not contain codes owned by another service")
+	}
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Services.Insert(service)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateServiceName):
+			v.AddError("name", "a service with this name already exists")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if len(input.Permissions) > 0 {
+		err = app.models.Permissions.InsertForService(service.ID, input.Permissions...)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.Logger.Info("New service successfully registered", "service", service.Name)
+
+	env := jsonz.Envelope{"service": service, "secret": secret}
+	err = jsonz.WriteJSendSuccess(w, http.StatusCreated, nil, env)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) createServiceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name   string `json:"name"`
+		Secret string `json:"secret"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Name != "", "name", "must be provided")
+	v.Check(input.Secret != "", "secret", "must be provided")
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	service, err := app.models.Services.GetByName(input.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.InvalidCredentialsResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := service.Password.Matches(input.Secret, app.cfg.argon2)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.InvalidCredentialsResponse(w, r)
+		return
+	}
+
+	if service.Suspended {
+		app.NotPermittedResponse(w, r)
+		return
+	}
+
+	token, err := app.models.Tokens.NewForService(service.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("Service successfully authenticated", "service", service.Name)
+
+	env := jsonz.Envelope{"authentication_token": token}
+	err = jsonz.WriteJSendSuccess(w, http.StatusCreated, nil, env)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
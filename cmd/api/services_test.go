@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestRegisterServiceHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	routes := app.routes()
+
+	admin := insertTestUser(t, app, "admin@example.com", "correct horse battery staple")
+
+	err := app.models.Permissions.AddForUser(admin.ID, "services:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Tokens.New(admin.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	register := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/service", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := register(`{"name": "widgets", "permissions": ["widgets:read", "widgets:write"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+
+	var res struct {
+		Data struct {
+			Secret string `json:"secret"`
+		} `json:"data"`
+	}
+
+	err = json.NewDecoder(rr.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := app.models.Services.GetByName("widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, err := service.Password.Matches(res.Data.Secret, app.cfg.argon2)
+	if err != nil || !match {
+		t.Errorf("got %t, %v matching the returned secret", match, err)
+	}
+
+	permissions, err := app.models.Permissions.GetAllForService(service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 2 || !permissions.Include("widgets:read") || !permissions.Include("widgets:write") {
+		t.Errorf("got permissions %v", permissions)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"Duplicate name", `{"name": "widgets"}`},
+		{"Another service's permission", `{"name": "gadgets", "permissions": ["users:read"]}`},
+		{"Empty permission", `{"name": "gadgets", "permissions": [""]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := register(tt.body)
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+			}
+		})
+	}
+}
+
+func TestServiceToken(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	service, secret := insertTestService(t, app, "widgets")
+
+	err := app.models.Permissions.InsertForService(service.ID, "widgets:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createToken := func(name, secret string) *httptest.ResponseRecorder {
+		body := `{"name": "` + name + `", "secret": "` + secret + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/service/token", strings.NewReader(body))
+		return serve(app.createServiceTokenHandler, r)
+	}
+
+	for _, rr := range []*httptest.ResponseRecorder{createToken("widgets", "wrong secret"), createToken("unknown", secret)} {
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("got status %d; want %d: %s", rr.Code, http.StatusUnauthorized, rr.Body)
+		}
+	}
+
+	rr := createToken("widgets", secret)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+
+	var res struct {
+		Data struct {
+			Token data.Token `json:"authentication_token"`
+		} `json:"data"`
+	}
+
+	err = json.NewDecoder(rr.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token resolves to the service, which holds the permissions it owns
+	// but cannot act as a user.
+	whoami := func(w http.ResponseWriter, r *http.Request) {
+		s := app.contextGetService(r)
+		if s == nil || !app.contextGetUser(r).IsAnonymous() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(s.Name))
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantCode int
+	}{
+		{"Owned permission", app.requirePermission("widgets:read", whoami), http.StatusOK},
+		{"Other permission", app.requirePermission("users:read", whoami), http.StatusForbidden},
+		{"User route", app.requireAuthenticatedUser(okHandler), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+res.Data.Token.Plaintext)
+
+			rr := httptest.NewRecorder()
+			app.authenticate(tt.handler).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantCode, rr.Body)
+			}
+			if tt.wantCode == http.StatusOK && rr.Body.String() != service.Name {
+				t.Errorf("got service %q; want %q", rr.Body, service.Name)
+			}
+		})
+	}
+}
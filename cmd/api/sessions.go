@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// maxUserAgentLength is the longest User-Agent header that is stored with a
+// session; longer values are truncated.
+const maxUserAgentLength = 512
+
+// sessionTouchInterval is the least time between recording the use of a
+// session.
+const sessionTouchInterval = time.Minute
+
+// sessionMetadata describes the session that a request is establishing or
+// refreshing.
+func sessionMetadata(r *http.Request, deviceLabel string) data.SessionMetadata {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	return data.SessionMetadata{
+		UserAgent:   userAgent,
+		IP:          clientIP(r),
+		DeviceLabel: deviceLabel,
+	}
+}
+
+// touchSession records that the session of the opaque access token has been
+// used by the request, unless that was last recorded less than
+// sessionTouchInterval ago, so that authenticated requests do not each write
+// to the database. Failing to record session activity does not fail the
+// request.
+func (app *app) touchSession(r *http.Request, token *data.Token) {
+	if token.SessionID == "" {
+		return
+	}
+
+	if token.LastUsedAt != nil && time.Since(*token.LastUsedAt) < sessionTouchInterval {
+		return
+	}
+
+	meta := sessionMetadata(r, "")
+
+	err := app.models.Tokens.TouchSession(token.SessionID, meta.IP, meta.UserAgent)
+	if err != nil {
+		app.Logger.Error(err.Error())
+	}
+}
+
+// currentSessionID returns the ID of the session that the request was
+// authenticated with, or an empty string if it is not known, such as for JWT
+// access tokens.
+func (app *app) currentSessionID(r *http.Request) (string, error) {
+	tokenPlaintext, ok := bearerToken(r)
+	if !ok || data.IsJWT(tokenPlaintext) {
+		return "", nil
+	}
+
+	token, err := app.models.Tokens.Get(data.ScopeAuthentication, tokenPlaintext)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return token.SessionID, nil
+}
+
+// writeSessions sends the given user's sessions, marking the one the request
+// was authenticated with, if any.
+func (app *app) writeSessions(w http.ResponseWriter, r *http.Request, user *data.User) {
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	currentID, err := app.currentSessionID(r)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	for _, session := range sessions {
+		session.Current = currentID != "" && session.ID == currentID
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"sessions": sessions})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeSessions(w, r, app.contextGetUser(r))
+}
+
+func (app *app) listUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.userForIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	app.writeSessions(w, r, user)
+}
+
+func (app *app) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	params := httprouter.ParamsFromContext(r.Context())
+	sessionID := params.ByName("id")
+
+	err := app.models.Tokens.DeleteSession(user.ID, sessionID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("User session revoked", "user", user.Email)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
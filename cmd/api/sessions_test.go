@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestListSessions(t *testing.T) {
+	app := newTestDBApplication(t)
+	routes := app.routes()
+
+	insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+
+	send := func(r *http.Request, ip, userAgent string) *httptest.ResponseRecorder {
+		r.RemoteAddr = ip + ":51234"
+		r.Header.Set("User-Agent", userAgent)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, r)
+		return rr
+	}
+
+	signIn := func(ip, userAgent, deviceLabel string) string {
+		body := `{"email": "alice@example.com", "password": "correct horse battery staple", "device_label": "` + deviceLabel + `"}`
+		rr := send(httptest.NewRequest(http.MethodPost, "/v1/token", strings.NewReader(body)), ip, userAgent)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("got status %d signing in: %s", rr.Code, rr.Body)
+		}
+
+		var res struct {
+			Data struct {
+				Token data.Token `json:"authenticated_tokens"`
+			} `json:"data"`
+		}
+
+		err := json.NewDecoder(rr.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res.Data.Token.Plaintext
+	}
+
+	listSessions := func(token, ip, userAgent string) []data.Session {
+		r := httptest.NewRequest(http.MethodGet, "/v1/user/sessions", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		rr := send(r, ip, userAgent)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d listing sessions: %s", rr.Code, rr.Body)
+		}
+
+		var res struct {
+			Data struct {
+				Sessions []data.Session `json:"sessions"`
+			} `json:"data"`
+		}
+
+		err := json.NewDecoder(rr.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.Data.Sessions) != 2 {
+			t.Fatalf("got %d sessions; want 2", len(res.Data.Sessions))
+		}
+
+		return res.Data.Sessions
+	}
+
+	laptop := signIn("192.0.2.1", "Firefox", "Laptop")
+	signIn("192.0.2.2", "Safari", "")
+
+	// Using a session records where it was last used from.
+	var current *data.Session
+	for _, session := range listSessions(laptop, "198.51.100.1", "Firefox 2") {
+		session := session
+		if session.Current {
+			if current != nil {
+				t.Fatal("more than one session is current")
+			}
+			current = &session
+		}
+	}
+
+	if current == nil {
+		t.Fatal("no session is current")
+	}
+	if current.IP != "198.51.100.1" || current.UserAgent != "Firefox 2" ||
+		current.DeviceLabel != "Laptop" || current.LastUsedAt == nil {
+		t.Errorf("got current session %+v", current)
+	}
+
+	// Further use within a minute is not recorded.
+	for _, session := range listSessions(laptop, "203.0.113.1", "Firefox 3") {
+		if session.Current && (session.IP != "198.51.100.1" || session.UserAgent != "Firefox 2") {
+			t.Errorf("got current session %+v; want the earlier use", session)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+)
+
+// signingKeyCheckInterval is how often the signing keys are reloaded from the
+// database and checked for scheduled rotation.
+const signingKeyCheckInterval = time.Minute
+
+// rotateSigningKeys periodically rotates the signing key once it reaches the
+// configured rotation interval, until ctx is cancelled. It also picks up keys
+// rotated by other instances of the service and drops keys whose grace period
+// has passed.
+func (app *app) rotateSigningKeys(ctx context.Context) {
+	ticker := time.NewTicker(signingKeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rotated, err := app.keys.RotateIfDue()
+		if err != nil {
+			app.Logger.Error(err.Error())
+			continue
+		}
+
+		if rotated {
+			app.Logger.Info("Signing key rotated", "kid", app.keys.Current().ID)
+		}
+	}
+}
+
+// rotateSigningKeyHandler forces an emergency rotation of the signing key.
+// Every other key is expired immediately, so all previously issued JWTs stop
+// verifying.
+func (app *app) rotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := app.keys.EmergencyRotate()
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Warn("Emergency signing key rotation", "kid", key.ID)
+
+	data := jsonz.Envelope{"signing_key": key.PublicJWK()}
+	err = jsonz.WriteJSendSuccess(w, http.StatusCreated, nil, data)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestOpenSigningKeysRequiresMasterKey(t *testing.T) {
+	var cfg appConfig
+	cfg.signingKeys.activeKeys = 2
+
+	// The configuration is rejected before the database is used.
+	_, err := openSigningKeys(nil, cfg)
+	if err == nil {
+		t.Error("signing keys opened without a master key")
+	}
+
+	cfg.signingKeys.masterKey = "not base64!"
+
+	_, err = openSigningKeys(nil, cfg)
+	if err == nil {
+		t.Error("signing keys opened with an invalid master key")
+	}
+}
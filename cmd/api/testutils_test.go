@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/m5lapp/go-service-toolkit/config"
+	"github.com/m5lapp/go-service-toolkit/webapp"
+	"github.com/m5lapp/go-user-service/internal/data"
+	"github.com/m5lapp/go-user-service/internal/testdb"
+	"golang.org/x/exp/slog"
+)
+
+// newTestApplication returns an app without a database, with signing keys
+// kept in memory and WebAuthn configured for https://id.example.com.
+func newTestApplication(t *testing.T) *app {
+	t.Helper()
+
+	keys, err := data.NewMemorySigningKeyManager(data.AlgorithmEdDSA, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = keys.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          "id.example.com",
+		RPDisplayName: "go-user-service",
+		RPOrigins:     []string{"https://id.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	app := &app{
+		WebApp:   webapp.New(config.Server{}, logger),
+		keys:     keys,
+		webAuthn: webAuthn,
+		decoyKey: []byte("test decoy key"),
+	}
+	app.cfg.oidc.issuer = "https://id.example.com"
+	app.cfg.argon2 = data.DefaultArgon2Params
+	app.cfg.passwords.policy = data.DefaultPasswordPolicy
+	app.cfg.lockout = data.LockoutPolicy{Threshold: 10, IPThreshold: 100, Duration: 15 * time.Minute}
+
+	return app
+}
+
+// newTestDBApplication returns a test app whose models are backed by a
+// database of the test's own, or skips the test if there is no test database.
+// See testdb.New.
+func newTestDBApplication(t *testing.T) *app {
+	t.Helper()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(testdb.New(t, "../../migrations"))
+
+	return app
+}
+
+// insertTestUser stores a new activated user with the given email address and
+// password.
+func insertTestUser(t *testing.T, app *app, email, password string) *data.User {
+	t.Helper()
+
+	user := &data.User{Email: email, Name: "Test User"}
+
+	err := user.Password.Set(password, app.cfg.argon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.Activated = true
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// insertTestService stores a new service with the given name and returns it
+// along with its secret.
+func insertTestService(t *testing.T, app *app, name string) (*data.Service, string) {
+	t.Helper()
+
+	service := &data.Service{Name: name, RedirectURIs: []string{"https://" + name + ".example.com/callback"}}
+
+	secret, err := service.GenerateSecret(app.cfg.argon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Services.Insert(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return service, secret
+}
+
+// okHandler is used as the next handler when testing middleware.
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+// serve sends r to h and returns the recorded response.
+func serve(h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
@@ -10,10 +11,28 @@ import (
 	"github.com/m5lapp/go-user-service/internal/data"
 )
 
+const (
+	// authTokenTTL is how long a user's authentication token is valid. Clients
+	// obtain a new one using the refresh token issued alongside it.
+	authTokenTTL = 15 * time.Minute
+	// refreshTokenTTL is how long a refresh token is valid. Each refresh
+	// replaces it with a new one, so a session lasts until it has been idle
+	// for this long.
+	refreshTokenTTL = 30 * 24 * time.Hour
+	// activationTokenTTL is how long a newly issued activation token is valid.
+	activationTokenTTL = 3 * 24 * time.Hour
+	// activationResendInterval is the minimum time that must pass between
+	// activation emails being sent to the same address.
+	activationResendInterval = 5 * time.Minute
+	// magicLinkTTL is how long a magic link sign in token is valid.
+	magicLinkTTL = 15 * time.Minute
+)
+
 func (app *app) createAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email       string `json:"email"`
+		Password    string `json:"password"`
+		DeviceLabel string `json:"device_label"`
 	}
 
 	err := jsonz.ReadJSON(w, r, &input)
@@ -26,41 +45,460 @@ func (app *app) createAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
 
 	validator.ValidateEmail(v, input.Email)
 	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateDeviceLabel(v, input.DeviceLabel)
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByIdentifier("email", input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	meta := sessionMetadata(r, input.DeviceLabel)
+
+	// Failed attempts are limited both per account and per source IP address,
+	// including attempts against email addresses that are not registered.
+	if !app.checkLoginAllowed(w, r, user, meta.IP) {
+		return
+	}
+
+	if user == nil {
+		app.recordLoginFailure(w, r, nil, meta.IP)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password, app.cfg.argon2)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.recordLoginFailure(w, r, user, meta.IP)
+		return
+	}
+
+	err = app.resetLoginFailures(user)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.rehashPassword(user, input.Password)
+
+	app.signIn(w, r, user, meta)
+}
+
+// rehashPassword replaces a user's password hash if the last successful
+// password match found that it uses a legacy algorithm or outdated parameters.
+// Failures are only logged, as the user has already proved their identity and
+// the hash will be upgraded at their next sign in instead.
+func (app *app) rehashPassword(user *data.User, plaintext string) {
+	if !user.Password.NeedsRehash() {
+		return
+	}
+
+	err := user.Password.Set(plaintext, app.cfg.argon2)
+	if err == nil {
+		err = app.models.Users.Update(user)
+	}
+
+	if err != nil {
+		app.Logger.Warn("Failed to rehash password", "user", user.Email, "error", err.Error())
+	}
+}
+
+// accountInactiveResponse is sent when a user who has proved their identity
+// cannot be signed in because their account is suspended or not activated.
+func (app *app) accountInactiveResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your account must be activated and not suspended to sign in"
+	app.ErrorResponse(w, r, http.StatusForbidden, message)
+}
+
+// signIn completes a sign in for a user who has proved their identity with a
+// single factor, provided that their account is active. Users with two-factor
+// authentication enabled must exchange the pending token that is sent instead,
+// along with a code, at POST /v1/token/mfa before they are signed in.
+func (app *app) signIn(w http.ResponseWriter, r *http.Request, user *data.User, meta data.SessionMetadata) {
+	if !user.CanSignIn() {
+		app.accountInactiveResponse(w, r)
+		return
+	}
+
+	enabled, err := app.models.MFA.IsEnabled(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if enabled {
+		token, err := app.models.Tokens.NewMFAPending(user.ID, mfaPendingTTL, meta)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		data := jsonz.Envelope{"mfa_required": true, "mfa_token": token}
+		err = jsonz.WriteJSendSuccess(w, http.StatusAccepted, nil, data)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueAuthTokens(w, r, user, nil, meta)
+}
+
+// issueAuthTokens creates a short-lived access token and a refresh token for
+// user and sends them in the response. The refresh token joins the family of
+// parent, the refresh token it replaces, or starts a new family if parent is
+// nil. The tokens' session is described by meta.
+func (app *app) issueAuthTokens(w http.ResponseWriter, r *http.Request, user *data.User, parent *data.Token, meta data.SessionMetadata) {
+	refreshToken, err := app.models.Tokens.NewInFamily(user.ID, refreshTokenTTL, data.ScopeRefresh, parent, meta)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	var token *data.Token
+
+	switch app.cfg.tokenFormat {
+	case data.TokenFormatJWT:
+		var permissions data.Permissions
+		permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		token, err = app.keys.Current().NewAccessToken(app.cfg.oidc.issuer, user,
+			authTokenTTL, data.ScopeAuthentication, permissions)
+	default:
+		token, err = app.models.Tokens.NewInFamily(user.ID, authTokenTTL, data.ScopeAuthentication, refreshToken, meta)
+	}
+
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	data := jsonz.Envelope{"authenticated_tokens": token, "refresh_token": refreshToken}
+	err = jsonz.WriteJSendSuccess(w, http.StatusCreated, nil, data)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) refreshAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.RefreshToken)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	parent, err := app.models.Tokens.UseRefreshToken(input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.InvalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.Logger.Warn("Refresh token reused, token family revoked")
+			app.InvalidAuthenticationTokenResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.GetByIdentifier("id", strconv.FormatInt(parent.UserID, 10))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.InvalidAuthenticationTokenResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A session cannot outlive the account being suspended, so it is ended
+	// rather than refreshed.
+	if !user.CanSignIn() {
+		err = app.models.Tokens.DeleteFamily(parent.FamilyID)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		app.InvalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	app.issueAuthTokens(w, r, user, parent, sessionMetadata(r, ""))
+}
+
+func (app *app) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
 
+	v := validator.New()
+	validator.ValidateEmail(v, input.Email)
 	if !v.Valid() {
 		app.FailedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// The same response is sent whether or not a matching user exists so that
+	// this endpoint cannot be used to discover which email addresses are
+	// registered.
+	message := "if a matching account exists, an email will be sent to it " +
+		"containing password reset instructions"
+	env := jsonz.Envelope{"message": message}
+
 	user, err := app.models.Users.GetByIdentifier("email", input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.InvalidCredentialsResponse(w, r)
+			err = jsonz.WriteJSendSuccess(w, http.StatusAccepted, nil, env)
+			if err != nil {
+				app.ServerErrorResponse(w, r, err)
+			}
 		default:
 			app.ServerErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	match, err := user.Password.Matches(input.Password)
+	if user.Activated && !user.Suspended {
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		app.Background(func() {
+			data := map[string]any{
+				"friendlyName":       user.FriendlyName,
+				"name":               user.Name,
+				"passwordResetToken": token.Plaintext,
+			}
+
+			err := app.mailer.Send(user.Email, "user_password_reset.tmpl", data)
+			if err != nil {
+				app.Logger.Error(err.Error())
+			}
+		})
+
+		app.Logger.Info("Password reset token issued", "user", user.Email)
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusAccepted, nil, env)
 	if err != nil {
 		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
 		return
 	}
 
-	if !match {
-		app.InvalidCredentialsResponse(w, r)
+	v := validator.New()
+	validator.ValidateEmail(v, input.Email)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// As with password resets, the response does not reveal whether the email
+	// address is registered, already activated or currently throttled.
+	message := "if a matching unactivated account exists, an email will be " +
+		"sent to it containing activation instructions"
+	env := jsonz.Envelope{"message": message}
+
+	user, err := app.models.Users.GetByIdentifier("email", input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = jsonz.WriteJSendSuccess(w, http.StatusAccepted, nil, env)
+			if err != nil {
+				app.ServerErrorResponse(w, r, err)
+			}
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated && !user.Suspended {
+		// Activation tokens always have the same TTL, so the latest expiry
+		// tells us when the last one was issued. This allows the throttle to
+		// work across multiple replicas without any extra state.
+		latestExpiry, err := app.models.Tokens.LatestExpiryForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		lastSent := latestExpiry.Add(-activationTokenTTL)
+		if time.Since(lastSent) < activationResendInterval {
+			app.Logger.Info("Activation email resend throttled", "user", user.Email)
+			err = jsonz.WriteJSendSuccess(w, http.StatusAccepted, nil, env)
+			if err != nil {
+				app.ServerErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, activationTokenTTL, data.ScopeActivation)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		app.Background(func() {
+			data := map[string]any{
+				"activationToken": token.Plaintext,
+				"friendlyName":    user.FriendlyName,
+				"name":            user.Name,
+				"userID":          user.UserID,
+			}
+
+			err := app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+			if err != nil {
+				app.Logger.Error(err.Error())
+			}
+		})
+
+		app.Logger.Info("Activation email resent", "user", user.Email)
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusAccepted, nil, env)
 	if err != nil {
 		app.ServerErrorResponse(w, r, err)
 	}
+}
 
-	data := map[string]*data.Token{"authenticated_tokens": token}
-	err = jsonz.WriteJSendSuccess(w, http.StatusCreated, nil, data)
+// userForToken resolves an authentication token to the User that owns it. JWT
+// access tokens are verified against the signing key, while opaque tokens are
+// looked up in the database. If the token is not valid, or its owner has been
+// suspended, ErrRecordNotFound is returned.
+func (app *app) userForToken(tokenPlaintext string) (*data.User, error) {
+	if !data.IsJWT(tokenPlaintext) {
+		return app.models.Users.GetForToken(data.ScopeAuthentication, tokenPlaintext)
+	}
+
+	claims, err := app.keys.ParseAccessToken(app.cfg.oidc.issuer, tokenPlaintext)
+	if err != nil || claims.Scope != data.ScopeAuthentication {
+		return nil, data.ErrRecordNotFound
+	}
+
+	user, err := app.models.Users.GetByIdentifier("user_id", claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	// As with opaque tokens, a suspended user's tokens stop working straight
+	// away rather than when they expire.
+	if user.Suspended {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return user, nil
+}
+
+// deleteAuthTokenHandler revokes the token that the request was authenticated
+// with. If it was issued alongside a refresh token, the whole token family is
+// revoked so that the session cannot be refreshed either.
+func (app *app) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if app.contextGetUser(r).IsAnonymous() && app.contextGetService(r) == nil {
+		app.AuthenticationRequiredResponse(w, r)
+		return
+	}
+
+	tokenPlaintext, _ := bearerToken(r)
+
+	if data.IsJWT(tokenPlaintext) {
+		app.BadRequestResponse(w, r, errors.New("JWT access tokens cannot be revoked"))
+		return
+	}
+
+	token, err := app.models.Tokens.Get(data.ScopeAuthentication, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.InvalidAuthenticationTokenResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if token.FamilyID != nil {
+		err = app.models.Tokens.DeleteFamily(token.FamilyID)
+	} else {
+		err = app.models.Tokens.DeleteByHash(token.Hash)
+	}
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// deleteAllAuthTokensHandler signs the authenticated user out everywhere by
+// revoking all of their authentication and refresh tokens.
+func (app *app) deleteAllAuthTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	scopes := []string{data.ScopeAuthentication, data.ScopeRefresh}
+	err := app.models.Tokens.DeleteAllForUserInScopes(user.ID, scopes)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("User signed out of all sessions", "user", user.Email)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
 	if err != nil {
 		app.ServerErrorResponse(w, r, err)
 	}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestDeleteAuthToken(t *testing.T) {
+	app := newTestDBApplication(t)
+	routes := app.routes()
+
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+	meta := data.SessionMetadata{IP: "192.0.2.1"}
+
+	signOut := func(path, token string) int {
+		r := httptest.NewRequest(http.MethodDelete, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	// newSession signs the user in, as issueAuthTokens does.
+	newSession := func() (access, refresh *data.Token) {
+		refresh, err := app.models.Tokens.NewInFamily(user.ID, time.Hour, data.ScopeRefresh, nil, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		access, err = app.models.Tokens.NewInFamily(user.ID, time.Hour, data.ScopeAuthentication, refresh, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return access, refresh
+	}
+
+	assertRevoked := func(token *data.Token, want bool) {
+		t.Helper()
+
+		_, err := app.models.Tokens.Get(token.Scope, token.Plaintext)
+		if revoked := errors.Is(err, data.ErrRecordNotFound); revoked != want {
+			t.Errorf("got %v for the %s token; want revoked %t", err, token.Scope, want)
+		}
+	}
+
+	if code := signOut("/v1/token", ""); code != http.StatusUnauthorized {
+		t.Errorf("got status %d signing out anonymously; want %d", code, http.StatusUnauthorized)
+	}
+
+	// Signing out of a session revokes its refresh token too, but not the
+	// user's other sessions.
+	access, refresh := newSession()
+	otherAccess, otherRefresh := newSession()
+
+	if code := signOut("/v1/token", access.Plaintext); code != http.StatusNoContent {
+		t.Fatalf("got status %d signing out; want %d", code, http.StatusNoContent)
+	}
+
+	assertRevoked(access, true)
+	assertRevoked(refresh, true)
+	assertRevoked(otherAccess, false)
+	assertRevoked(otherRefresh, false)
+
+	// Tokens without a refresh token are revoked on their own.
+	single, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := signOut("/v1/token", single.Plaintext); code != http.StatusNoContent {
+		t.Fatalf("got status %d signing out; want %d", code, http.StatusNoContent)
+	}
+
+	assertRevoked(single, true)
+	assertRevoked(otherAccess, false)
+
+	// Signing out everywhere revokes every session, but leaves tokens of other
+	// scopes alone.
+	activation, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastAccess, lastRefresh := newSession()
+
+	if code := signOut("/v1/token/all", otherAccess.Plaintext); code != http.StatusNoContent {
+		t.Fatalf("got status %d signing out everywhere; want %d", code, http.StatusNoContent)
+	}
+
+	assertRevoked(otherAccess, true)
+	assertRevoked(otherRefresh, true)
+	assertRevoked(lastAccess, true)
+	assertRevoked(lastRefresh, true)
+	assertRevoked(activation, false)
+}
+
+func TestOAuthRevokeHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+	client, secret := insertTestService(t, app, "photo-app")
+	other, _ := insertTestService(t, app, "other-app")
+
+	newToken := func(client *data.Service) *data.Token {
+		token, err := app.models.Tokens.NewForClient(user.ID, client.ID, time.Hour, data.ScopeAuthentication,
+			"openid", data.SessionMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	revoke := func(form url.Values, secret string) int {
+		r := httptest.NewRequest(http.MethodPost, "/oauth/revoke", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(client.Name, secret)
+		return serve(app.oauthRevokeHandler, r).Code
+	}
+
+	own := newToken(client)
+	others := newToken(other)
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		secret   string
+		wantCode int
+	}{
+		{"Wrong secret", url.Values{"token": {own.Plaintext}}, "wrong secret", http.StatusUnauthorized},
+		{"No token", url.Values{}, secret, http.StatusBadRequest},
+		{"Unknown token", url.Values{"token": {"ABCDEFGHIJKLMNOPQRSTUVWXYZ"}}, secret, http.StatusOK},
+		{"Another client's token", url.Values{"token": {others.Plaintext}}, secret, http.StatusOK},
+		{"Own token", url.Values{"token": {own.Plaintext}, "token_type_hint": {"access_token"}}, secret, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := revoke(tt.form, tt.secret); code != tt.wantCode {
+				t.Errorf("got status %d; want %d", code, tt.wantCode)
+			}
+		})
+	}
+
+	// Only the client's own token was revoked.
+	_, err := app.models.Tokens.Get(data.ScopeAuthentication, own.Plaintext)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("got %v for the client's own token; want ErrRecordNotFound", err)
+	}
+
+	_, err = app.models.Tokens.Get(data.ScopeAuthentication, others.Plaintext)
+	if err != nil {
+		t.Errorf("got %v for another client's token; want it to be left alone", err)
+	}
+}
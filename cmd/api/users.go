@@ -4,7 +4,6 @@ import (
 	"errors"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
@@ -42,14 +41,14 @@ func (app *app) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 		Activated:    false,
 	}
 
-	err = user.Password.Set(input.Password)
+	err = user.Password.Set(input.Password, app.cfg.argon2)
 	if err != nil {
 		app.ServerErrorResponse(w, r, err)
 		return
 	}
 
 	v := validator.New()
-	data.ValidateUser(v, user)
+	data.ValidateUser(v, user, app.cfg.passwords.policy)
 	if !v.Valid() {
 		app.FailedValidationResponse(w, r, v.Errors)
 		return
@@ -68,7 +67,7 @@ func (app *app) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate a token for the user to activate with.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(user.ID, activationTokenTTL, data.ScopeActivation)
 	if err != nil {
 		app.ServerErrorResponse(w, r, err)
 		return
@@ -155,6 +154,80 @@ func (app *app) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (app *app) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.cfg.passwords.policy.Validate(v, input.Password, user)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.Password, app.cfg.argon2)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.EditConflictResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The reset token is single use, and any sessions that were established
+	// with the old password should no longer be trusted.
+	scopes := []string{data.ScopePasswordReset, data.ScopeAuthentication, data.ScopeRefresh}
+	err = app.models.Tokens.DeleteAllForUserInScopes(user.ID, scopes)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.Logger.Info("User password successfully reset", "user", user.Email)
+
+	env := jsonz.Envelope{"message": "your password was successfully reset"}
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, env)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
 func (app *app) getUserHandler(w http.ResponseWriter, r *http.Request) {
 	params := httprouter.ParamsFromContext(r.Context())
 	value := params.ByName("value")
@@ -195,7 +268,10 @@ func (app *app) getUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"user": user})
+	headers := make(http.Header)
+	headers.Set("ETag", userETag(user))
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, headers, jsonz.Envelope{"user": user})
 	if err != nil {
 		app.ServerErrorResponse(w, r, err)
 	}
@@ -211,14 +287,16 @@ func (app *app) authUserHandler(w http.ResponseWriter, r *http.Request) {
 		app.BadRequestResponse(w, r, err)
 	}
 
-	v := validator.New()
-	data.ValidateTokenPlaintext(v, input.Token)
-	if !v.Valid() {
-		app.InvalidAuthenticationTokenResponse(w, r)
-		return
+	if !data.IsJWT(input.Token) {
+		v := validator.New()
+		data.ValidateTokenPlaintext(v, input.Token)
+		if !v.Valid() {
+			app.InvalidAuthenticationTokenResponse(w, r)
+			return
+		}
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopeAuthentication, input.Token)
+	user, err := app.userForToken(input.Token)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -238,6 +316,79 @@ func (app *app) authUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (app *app) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if !ifMatch(r, userETag(user)) {
+		app.EditConflictResponse(w, r)
+		return
+	}
+
+	// Nil pointers indicate that the corresponding field should be left
+	// unchanged.
+	var input struct {
+		Name         *string         `json:"name"`
+		FriendlyName *string         `json:"friendly_name"`
+		BirthDate    *jsonz.DateOnly `json:"birth_date"`
+		Gender       *string         `json:"gender"`
+		CountryCode  *string         `json:"country_code"`
+		TimeZone     *string         `json:"time_zone"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.FriendlyName != nil {
+		user.FriendlyName = input.FriendlyName
+	}
+	if input.BirthDate != nil {
+		user.BirthDate = input.BirthDate
+	}
+	if input.Gender != nil {
+		user.Gender = input.Gender
+	}
+	if input.CountryCode != nil {
+		user.CountryCode = input.CountryCode
+	}
+	if input.TimeZone != nil {
+		user.TimeZone = input.TimeZone
+	}
+
+	v := validator.New()
+	data.ValidateUser(v, user, app.cfg.passwords.policy)
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.EditConflictResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("User successfully updated", "user", user.Email)
+
+	headers := make(http.Header)
+	headers.Set("ETag", userETag(user))
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, headers, jsonz.Envelope{"user": user})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
 func (app *app) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email string `json:"email"`
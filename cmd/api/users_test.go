@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	user := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+
+	// The response does not reveal whether the email address is registered.
+	request := func(email string) *httptest.ResponseRecorder {
+		body := `{"email": "` + email + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/user/password-reset", strings.NewReader(body))
+		return serve(app.createPasswordResetTokenHandler, r)
+	}
+
+	registered := request("alice@example.com")
+	unregistered := request("bob@example.com")
+	if registered.Code != http.StatusAccepted || registered.Body.String() != unregistered.Body.String() {
+		t.Errorf("got %d %s for a registered email and %d %s for another",
+			registered.Code, registered.Body, unregistered.Code, unregistered.Body)
+	}
+
+	session, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(password string) *httptest.ResponseRecorder {
+		body := `{"token": "` + reset.Plaintext + `", "password": "` + password + `"}`
+		r := httptest.NewRequest(http.MethodPut, "/v1/user/password", strings.NewReader(body))
+		return serve(app.updateUserPasswordHandler, r)
+	}
+
+	rr := update("kT9#vQ2!mZ7$wB")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+
+	stored, err := app.models.Users.GetByIdentifier("email", user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, err := stored.Password.Matches("kT9#vQ2!mZ7$wB", app.cfg.argon2)
+	if err != nil || !match {
+		t.Errorf("got %t, %v matching the new password", match, err)
+	}
+	if stored.Version == user.Version {
+		t.Error("user's version was not changed")
+	}
+
+	// The user is signed out everywhere, and the reset token cannot be used
+	// again.
+	_, err = app.models.Users.GetForToken(data.ScopeAuthentication, session.Plaintext)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("got %v for the user's authentication token; want ErrRecordNotFound", err)
+	}
+
+	rr = update("another g00d Passw0rd!")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d reusing the reset token; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestResendActivation(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	user := &data.User{Email: "alice@example.com", Name: "Test User"}
+
+	err := user.Password.Set("correct horse battery staple", app.cfg.argon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activated := insertTestUser(t, app, "bob@example.com", "correct horse battery staple")
+
+	resend := func(email string) *httptest.ResponseRecorder {
+		body := `{"email": "` + email + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/user/activate/resend", strings.NewReader(body))
+		return serve(app.createActivationTokenHandler, r)
+	}
+
+	// The first token was issued long enough ago for another to be sent.
+	old, err := app.models.Tokens.New(user.ID, activationTokenTTL-2*activationResendInterval, data.ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := resend("alice@example.com")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+
+	_, err = app.models.Users.GetForToken(data.ScopeActivation, old.Plaintext)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("got %v for the old activation token; want ErrRecordNotFound", err)
+	}
+
+	expiry, err := app.models.Tokens.LatestExpiryForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expiry) < activationTokenTTL-time.Minute {
+		t.Fatalf("got new token expiry %v", expiry)
+	}
+
+	// Another resend straight away is throttled, leaving the new token alone,
+	// but the response is the same.
+	throttled := resend("alice@example.com")
+
+	latest, err := app.models.Tokens.LatestExpiryForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest.Equal(expiry) {
+		t.Error("a token was issued while resending was throttled")
+	}
+
+	// Activated users are not sent tokens.
+	resend(activated.Email)
+
+	latest, err = app.models.Tokens.LatestExpiryForUser(data.ScopeActivation, activated.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest.IsZero() {
+		t.Error("an activated user was issued an activation token")
+	}
+
+	// None of the responses reveal whether the email address is registered.
+	for _, other := range []*httptest.ResponseRecorder{throttled, resend(activated.Email), resend("carol@example.com")} {
+		if other.Code != rr.Code || other.Body.String() != rr.Body.String() {
+			t.Errorf("got %d %s; want %d %s", other.Code, other.Body, rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"No header", "", true},
+		{"Match", `"3"`, true},
+		{"One of several", `"2", "3"`, true},
+		{"Any", "*", true},
+		{"Stale", `"2"`, false},
+		{"Unquoted", "3", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/v1/user", nil)
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+
+			got := ifMatch(r, userETag(&data.User{Version: 3}))
+			if got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	inserted := insertTestUser(t, app, "alice@example.com", "correct horse battery staple")
+	etag := userETag(inserted)
+
+	update := func(body, ifMatch string) *httptest.ResponseRecorder {
+		user, err := app.models.Users.GetByIdentifier("email", inserted.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodPatch, "/v1/user", strings.NewReader(body))
+		r.Header.Set("If-Match", ifMatch)
+		r = app.contextSetUser(r, user)
+		return serve(app.updateUserHandler, r)
+	}
+
+	rr := update(`{"friendly_name": "Ally", "country_code": "GB"}`, etag)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Error("ETag did not change")
+	}
+
+	user, err := app.models.Users.GetByIdentifier("email", inserted.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fields that were not given are left unchanged.
+	if user.Name != "Test User" || user.FriendlyName == nil || *user.FriendlyName != "Ally" ||
+		user.CountryCode == nil || *user.CountryCode != "GB" {
+		t.Errorf("got user %+v", user)
+	}
+
+	rr = update(`{"name": "Alice Liddell"}`, etag)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("got status %d with a stale ETag; want %d", rr.Code, http.StatusConflict)
+	}
+
+	rr = update(`{"name": ""}`, userETag(user))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an empty name; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/julienschmidt/httprouter"
+	"github.com/m5lapp/go-service-toolkit/serialisation/jsonz"
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// webAuthnCeremonyTTL is how long a client has to finish a WebAuthn
+// registration or sign in after starting it.
+const webAuthnCeremonyTTL = 5 * time.Minute
+
+// webAuthnUser loads the given user's registered WebAuthn credentials.
+func (app *app) webAuthnUser(user *data.User) (*data.WebAuthnUser, error) {
+	credentials, err := app.models.WebAuthn.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.WebAuthnUser{User: user, Credentials: credentials}, nil
+}
+
+// decoyCredentialID returns the ID of a credential that does not exist for an
+// email address without passkeys. The same ID is returned each time for the
+// same address, as a real user's credential IDs would be.
+func (app *app) decoyCredentialID(email string) []byte {
+	mac := hmac.New(sha256.New, app.decoyKey)
+	mac.Write([]byte(strings.ToLower(email)))
+	return mac.Sum(nil)
+}
+
+// writeCeremony sends the token for a newly started ceremony along with the
+// options to pass to the browser's WebAuthn API.
+func (app *app) writeCeremony(w http.ResponseWriter, r *http.Request, token *data.Token, options any) {
+	data := jsonz.Envelope{"ceremony": token, "options": options}
+	err := jsonz.WriteJSendSuccess(w, http.StatusOK, nil, data)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) beginWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.webAuthnUser(app.contextGetUser(r))
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	creation, session, err := app.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(user.CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.WebAuthn.NewCeremony(user.ID, webAuthnCeremonyTTL,
+		data.CeremonyWebAuthnRegistration, session)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeCeremony(w, r, token, creation)
+}
+
+func (app *app) finishWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string          `json:"token"`
+		Name           string          `json:"name"`
+		Credential     json.RawMessage `json:"credential"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	data.ValidateCredentialName(v, input.Name)
+	v.Check(len(input.Credential) > 0, "credential", "must be provided")
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.webAuthnUser(app.contextGetUser(r))
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	userID, session, err := app.models.WebAuthn.ConsumeCeremony(data.CeremonyWebAuthnRegistration, input.TokenPlaintext)
+	if err == nil && userID != user.ID {
+		err = data.ErrRecordNotFound
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired registration token")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(input.Credential))
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	credential, err := app.webAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	webAuthnCredential := &data.WebAuthnCredential{
+		UserID:     user.ID,
+		Name:       input.Name,
+		Credential: *credential,
+	}
+
+	err = app.models.WebAuthn.Insert(webAuthnCredential)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateCredential):
+			v.AddError("credential", "is already registered")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("WebAuthn credential registered", "user", user.Email)
+
+	data := jsonz.Envelope{"credential": webAuthnCredential}
+	err = jsonz.WriteJSendSuccess(w, http.StatusCreated, nil, data)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) listWebAuthnCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	credentials, err := app.models.WebAuthn.GetAllForUser(user.ID)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonz.WriteJSendSuccess(w, http.StatusOK, nil, jsonz.Envelope{"credentials": credentials})
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) deleteWebAuthnCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		app.NotFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.WebAuthn.Delete(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.NotFoundResponse(w, r)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.Logger.Info("WebAuthn credential deleted", "user", user.Email)
+
+	err = jsonz.WriteJSON(w, http.StatusNoContent, nil, nil)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+	}
+}
+
+// beginWebAuthnLoginHandler starts a sign in. If an email address is given,
+// the user's credentials are listed in the options. Otherwise the
+// authenticator chooses a discoverable credential (passkey) and the user is
+// identified when the sign in is finished.
+func (app *app) beginWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	var userID int64
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+
+	// A passkey stands in for both the password and the second factor, so the
+	// authenticator must verify the user, such as with a PIN or biometric.
+	uv := webauthn.WithUserVerification(protocol.VerificationRequired)
+
+	if input.Email == "" {
+		assertion, session, err = app.webAuthn.BeginDiscoverableLogin(uv)
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		v := validator.New()
+		validator.ValidateEmail(v, input.Email)
+		if !v.Valid() {
+			app.FailedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		user, err := app.models.Users.GetByIdentifier("email", input.Email)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		var webAuthnUser *data.WebAuthnUser
+		if user != nil {
+			webAuthnUser, err = app.webAuthnUser(user)
+			if err != nil {
+				app.ServerErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		if webAuthnUser != nil && len(webAuthnUser.Credentials) > 0 {
+			assertion, session, err = app.webAuthn.BeginLogin(webAuthnUser, uv)
+			userID = user.ID
+		} else {
+			// Answering differently for an email address without passkeys
+			// would reveal whether it is registered, so a ceremony is started
+			// for a credential that does not exist instead. It can never be
+			// finished.
+			decoy := protocol.CredentialDescriptor{
+				Type:         protocol.PublicKeyCredentialType,
+				CredentialID: app.decoyCredentialID(input.Email),
+			}
+			assertion, session, err = app.webAuthn.BeginDiscoverableLogin(uv,
+				webauthn.WithAllowedCredentials([]protocol.CredentialDescriptor{decoy}))
+		}
+		if err != nil {
+			app.ServerErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	token, err := app.models.WebAuthn.NewCeremony(userID, webAuthnCeremonyTTL,
+		data.CeremonyWebAuthnLogin, session)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeCeremony(w, r, token, assertion)
+}
+
+// finishWebAuthnLoginHandler verifies the assertion made by the authenticator
+// and signs the user in. Two-factor authentication is not asked for, as the
+// authenticator has already verified the user.
+func (app *app) finishWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string          `json:"token"`
+		DeviceLabel    string          `json:"device_label"`
+		Credential     json.RawMessage `json:"credential"`
+	}
+
+	err := jsonz.ReadJSON(w, r, &input)
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	data.ValidateDeviceLabel(v, input.DeviceLabel)
+	v.Check(len(input.Credential) > 0, "credential", "must be provided")
+
+	if !v.Valid() {
+		app.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, session, err := app.models.WebAuthn.ConsumeCeremony(data.CeremonyWebAuthnLogin, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired sign in token")
+			app.FailedValidationResponse(w, r, v.Errors)
+		default:
+			app.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(input.Credential))
+	if err != nil {
+		app.BadRequestResponse(w, r, err)
+		return
+	}
+
+	meta := sessionMetadata(r, input.DeviceLabel)
+
+	var user *data.WebAuthnUser
+
+	// lookupUser finds the user identified by the given field, keeping any
+	// unexpected error so that it is not reported as invalid credentials.
+	var lookupErr error
+	lookupUser := func(field, value string) (*data.WebAuthnUser, error) {
+		u, err := app.models.Users.GetByIdentifier(field, value)
+		if err == nil {
+			user, err = app.webAuthnUser(u)
+		}
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			lookupErr = err
+		}
+		return user, err
+	}
+
+	// The user is only known in advance if the ceremony was started with an
+	// email address, otherwise they are found from the credential.
+	if userID != 0 {
+		_, err = lookupUser("id", strconv.FormatInt(userID, 10))
+		if lookupErr != nil {
+			app.ServerErrorResponse(w, r, lookupErr)
+			return
+		}
+	}
+
+	// Failed attempts count towards the same per account and per IP address
+	// limits as password sign ins.
+	if !app.checkLoginAllowed(w, r, user.Account(), meta.IP) {
+		return
+	}
+
+	var validated *webauthn.Credential
+
+	switch {
+	case userID == 0:
+		validated, err = app.webAuthn.ValidateDiscoverableLogin(
+			func(rawID, userHandle []byte) (webauthn.User, error) {
+				return lookupUser("user_id", string(userHandle))
+			},
+			*session, parsed)
+	case err == nil:
+		validated, err = app.webAuthn.ValidateLogin(user, *session, parsed)
+	}
+
+	if lookupErr != nil {
+		app.ServerErrorResponse(w, r, lookupErr)
+		return
+	}
+
+	if err != nil {
+		app.recordLoginFailure(w, r, user.Account(), meta.IP)
+		return
+	}
+
+	if userID == 0 && !app.checkLoginAllowed(w, r, user.User, meta.IP) {
+		return
+	}
+
+	credential := user.Credential(validated.ID)
+	credential.Credential = *validated
+
+	err = app.models.WebAuthn.RecordLogin(credential)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// A signature counter that has not increased means that the credential's
+	// private key may have been copied, so it can no longer be used to sign in.
+	if credential.CloneWarning {
+		app.Logger.Warn("WebAuthn credential may be cloned", "user", user.Email,
+			"credential", credential.ID)
+		app.InvalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.resetLoginFailures(user.User)
+	if err != nil {
+		app.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !user.CanSignIn() {
+		app.accountInactiveResponse(w, r)
+		return
+	}
+
+	app.issueAuthTokens(w, r, user.User, nil, meta)
+}
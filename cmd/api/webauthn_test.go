@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/m5lapp/go-user-service/internal/data"
+)
+
+// softwareAuthenticator holds a single ES256 credential and makes assertions
+// with it, as a passkey provider would.
+type softwareAuthenticator struct {
+	t       *testing.T
+	id      []byte
+	key     *ecdsa.PrivateKey
+	counter uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &softwareAuthenticator{t: t, id: id, key: key}
+}
+
+// credential returns the credential as it would have been stored when it was
+// registered.
+func (a *softwareAuthenticator) credential() webauthn.Credential {
+	a.t.Helper()
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return webauthn.Credential{ID: a.id, PublicKey: publicKey}
+}
+
+// assert signs the session's challenge for the given relying party and
+// origin, returning the parsed response as the browser would send it.
+func (a *softwareAuthenticator) assert(session *webauthn.SessionData, rpID, origin string, userHandle []byte) *protocol.ParsedCredentialAssertionData {
+	a.t.Helper()
+
+	clientData, err := json.Marshal(map[string]string{
+		"type":      string(protocol.AssertCeremony),
+		"challenge": session.Challenge,
+		"origin":    origin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	// The authenticator data is the RP ID hash, the user present and user
+	// verified flags, then the signature counter.
+	a.counter++
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append(rpIDHash[:], 0x05)
+	authData = binary.BigEndian.AppendUint32(authData, a.counter)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	body, err := json.Marshal(map[string]any{
+		"id":    enc(a.id),
+		"rawId": enc(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    enc(clientData),
+			"authenticatorData": enc(authData),
+			"signature":         enc(signature),
+			"userHandle":        enc(userHandle),
+		},
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return parsed
+}
+
+// newWebAuthnUser returns a user who has registered the given authenticators.
+func newWebAuthnUser(authenticators ...*softwareAuthenticator) *data.WebAuthnUser {
+	user := &data.WebAuthnUser{
+		User: &data.User{ID: 1, UserID: "a1b2c3d4e5f6a7b8", Email: "alice@example.com", Activated: true},
+	}
+
+	for i, a := range authenticators {
+		user.Credentials = append(user.Credentials, &data.WebAuthnCredential{
+			ID:         int64(i + 1),
+			UserID:     user.ID,
+			Credential: a.credential(),
+		})
+	}
+
+	return user
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	app := newTestApplication(t)
+	uv := webauthn.WithUserVerification(protocol.VerificationRequired)
+
+	passkey := newSoftwareAuthenticator(t)
+	user := newWebAuthnUser(passkey)
+
+	_, session, err := app.webAuthn.BeginLogin(user, uv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertion := passkey.assert(session, "id.example.com", "https://id.example.com", nil)
+
+	validated, err := app.webAuthn.ValidateLogin(user, *session, assertion)
+	if err != nil {
+		t.Fatalf("validating assertion: %s", err)
+	}
+	if !bytes.Equal(validated.ID, passkey.id) || validated.Authenticator.SignCount != 1 {
+		t.Errorf("got credential %x with counter %d", validated.ID, validated.Authenticator.SignCount)
+	}
+
+	t.Run("Replayed assertion", func(t *testing.T) {
+		_, next, err := app.webAuthn.BeginLogin(user, uv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.webAuthn.ValidateLogin(user, *next, assertion)
+		if err == nil {
+			t.Error("assertion for an earlier challenge was accepted")
+		}
+	})
+
+	t.Run("Other origin", func(t *testing.T) {
+		phished := passkey.assert(session, "id.example.com", "https://id.example.net", nil)
+
+		_, err := app.webAuthn.ValidateLogin(user, *session, phished)
+		if err == nil {
+			t.Error("assertion made for another origin was accepted")
+		}
+	})
+
+	t.Run("Other credential", func(t *testing.T) {
+		other := newSoftwareAuthenticator(t)
+		_, err := app.webAuthn.ValidateLogin(user, *session,
+			other.assert(session, "id.example.com", "https://id.example.com", nil))
+		if err == nil {
+			t.Error("assertion by an unregistered credential was accepted")
+		}
+	})
+
+	t.Run("Cloned credential", func(t *testing.T) {
+		user.Credentials[0].Credential.Authenticator.SignCount = 100
+
+		validated, err := app.webAuthn.ValidateLogin(user, *session,
+			passkey.assert(session, "id.example.com", "https://id.example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !validated.Authenticator.CloneWarning {
+			t.Error("signature counter that did not increase was not flagged")
+		}
+	})
+}
+
+func TestWebAuthnDiscoverableLogin(t *testing.T) {
+	app := newTestApplication(t)
+	uv := webauthn.WithUserVerification(protocol.VerificationRequired)
+
+	passkey := newSoftwareAuthenticator(t)
+	user := newWebAuthnUser(passkey)
+
+	// findUser resolves the user handle in the assertion, as the sign in
+	// handler does with the user_id.
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		if string(userHandle) != user.UserID {
+			return nil, data.ErrRecordNotFound
+		}
+		return user, nil
+	}
+
+	_, session, err := app.webAuthn.BeginDiscoverableLogin(uv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertion := passkey.assert(session, "id.example.com", "https://id.example.com", user.WebAuthnID())
+
+	_, err = app.webAuthn.ValidateDiscoverableLogin(findUser, *session, assertion)
+	if err != nil {
+		t.Fatalf("validating assertion: %s", err)
+	}
+
+	// A ceremony started for an email address without passkeys only allows a
+	// decoy credential, so no real credential can finish it.
+	decoy := protocol.CredentialDescriptor{
+		Type:         protocol.PublicKeyCredentialType,
+		CredentialID: app.decoyCredentialID(user.Email),
+	}
+	_, session, err = app.webAuthn.BeginDiscoverableLogin(uv,
+		webauthn.WithAllowedCredentials([]protocol.CredentialDescriptor{decoy}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertion = passkey.assert(session, "id.example.com", "https://id.example.com", user.WebAuthnID())
+
+	_, err = app.webAuthn.ValidateDiscoverableLogin(findUser, *session, assertion)
+	if err == nil {
+		t.Error("decoy ceremony was finished with a real credential")
+	}
+}
+
+func TestDecoyCredentialID(t *testing.T) {
+	app := newTestApplication(t)
+
+	id := app.decoyCredentialID("alice@example.com")
+
+	if !bytes.Equal(id, app.decoyCredentialID("Alice@Example.com")) {
+		t.Error("decoy credential ID depends on the email address's case")
+	}
+	if bytes.Equal(id, app.decoyCredentialID("bob@example.com")) {
+		t.Error("decoy credential ID is the same for different email addresses")
+	}
+
+	app.decoyKey = []byte("another decoy key")
+	if bytes.Equal(id, app.decoyCredentialID("alice@example.com")) {
+		t.Error("decoy credential ID does not depend on the key")
+	}
+}
@@ -6,16 +6,34 @@ require golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1
 
 require github.com/lib/pq v1.10.9
 
+require github.com/golang-jwt/jwt/v5 v5.0.0
+
+require (
+	github.com/fxamacker/cbor/v2 v2.4.0 // indirect
+	github.com/go-webauthn/webauthn v0.8.6
+	github.com/go-webauthn/x v0.1.4 // indirect
+	github.com/google/go-tpm v0.9.0 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/mitchellh/mapstructure v1.5.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+)
+
+require (
+	github.com/boombuler/barcode v1.0.1-0.20190219062509-6c824513bacc // indirect
+	github.com/pquerna/otp v1.5.0
+)
+
 require (
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce // indirect
-	golang.org/x/time v0.3.0 // indirect
+	golang.org/x/time v0.3.0
 )
 
 require (
 	github.com/kjk/betterguid v0.0.0-20170621091430-c442874ba63a
 	github.com/m5lapp/go-service-toolkit v0.0.0-20230620000542-61a2a39348df
-	golang.org/x/crypto v0.10.0
+	golang.org/x/crypto v0.11.0
 )
 
 require (
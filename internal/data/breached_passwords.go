@@ -0,0 +1,161 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxBreachLineLength is the longest line expected in a breached password
+// file: a SHA-1 hash, a colon, a count and a line ending.
+const maxBreachLineLength = 64
+
+// BreachedPasswords looks passwords up in a local copy of the Have I Been
+// Pwned Pwned Passwords corpus, as produced by the official downloader. Each
+// line holds an upper case SHA-1 hash, made of the five character range prefix
+// followed by the suffix returned by the range API, and the number of times it
+// has been seen, such as "000000005AD76BD555C1D6D771DE417A4B87E4B4:10". Lines
+// must be sorted by hash so that they can be searched without reading the
+// whole file, which can be tens of gigabytes.
+type BreachedPasswords struct {
+	file *os.File
+	size int64
+}
+
+// OpenBreachedPasswords opens the breached password file at path and checks
+// that it is in the expected format.
+func OpenBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	b := &BreachedPasswords{file: file, size: info.Size()}
+
+	line, _, err := b.lineAt(0)
+	if err == nil && !validBreachLine(line) {
+		err = fmt.Errorf("%s: expected lines in the format HASH:COUNT", path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Close closes the underlying file.
+func (b *BreachedPasswords) Close() error {
+	return b.file.Close()
+}
+
+// Contains reports whether password appears in the breached password file.
+// It is safe for concurrent use.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := []byte(hex.EncodeToString(sum[:]))
+	hash = bytes.ToUpper(hash)
+
+	// Binary search over byte offsets. lo is always the start of a line, and
+	// every line before it sorts before the hash. Every line starting at or
+	// after hi sorts after it.
+	lo, hi := int64(0), b.size
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, err := b.lineStartFrom(mid)
+		if err != nil {
+			return false, err
+		}
+
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		line, next, err := b.lineAt(start)
+		if err != nil {
+			return false, err
+		}
+
+		if len(line) < len(hash) {
+			return false, fmt.Errorf("malformed breached password line at offset %d", start)
+		}
+
+		switch bytes.Compare(bytes.ToUpper(line[:len(hash)]), hash) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = next
+		default:
+			hi = start
+		}
+	}
+
+	return false, nil
+}
+
+// lineStartFrom returns the offset of the first line that starts at or after
+// offset, or the size of the file if there is none.
+func (b *BreachedPasswords) lineStartFrom(offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+
+	buf := make([]byte, maxBreachLineLength)
+
+	for pos := offset - 1; pos < b.size; pos += int64(len(buf)) {
+		n, err := b.file.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+	}
+
+	return b.size, nil
+}
+
+// lineAt returns the line starting at offset without its line ending, and the
+// offset of the line after it.
+func (b *BreachedPasswords) lineAt(offset int64) ([]byte, int64, error) {
+	buf := make([]byte, maxBreachLineLength)
+
+	n, err := b.file.ReadAt(buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, 0, err
+	}
+	buf = buf[:n]
+
+	next := offset + int64(n)
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		buf = buf[:i]
+		next = offset + int64(i) + 1
+	}
+
+	return bytes.TrimSuffix(buf, []byte("\r")), next, nil
+}
+
+// validBreachLine reports whether line is a hex encoded SHA-1 hash followed by
+// a colon.
+func validBreachLine(line []byte) bool {
+	hash, _, found := bytes.Cut(line, []byte(":"))
+	if !found || len(hash) != sha1.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(string(hash))
+	return err == nil
+}
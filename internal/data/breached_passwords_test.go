@@ -0,0 +1,100 @@
+package data
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// breachLine returns the line for password in a breached password file.
+func breachLine(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:])) + ":42"
+}
+
+// writeBreachedPasswords writes a sorted breached password file containing
+// the given passwords and returns its path.
+func writeBreachedPasswords(t *testing.T, lineEnding string, passwords []string) string {
+	t.Helper()
+
+	lines := make([]string, len(passwords))
+	for i, p := range passwords {
+		lines[i] = breachLine(p)
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	err := os.WriteFile(path, []byte(strings.Join(lines, lineEnding)+lineEnding), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestBreachedPasswordsContains(t *testing.T) {
+	var passwords []string
+	for i := 0; i < 500; i++ {
+		passwords = append(passwords, fmt.Sprintf("breached-%d", i))
+	}
+
+	for _, lineEnding := range []string{"\n", "\r\n"} {
+		breached, err := OpenBreachedPasswords(writeBreachedPasswords(t, lineEnding, passwords))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer breached.Close()
+
+		for _, p := range passwords {
+			found, err := breached.Contains(p)
+			if err != nil || !found {
+				t.Errorf("%q: got %t, %v; want found", p, found, err)
+			}
+		}
+
+		for _, p := range []string{"", "breached-500", "kT9#vQ2!mZ7$wB"} {
+			found, err := breached.Contains(p)
+			if err != nil || found {
+				t.Errorf("%q: got %t, %v; want not found", p, found, err)
+			}
+		}
+	}
+}
+
+func TestOpenBreachedPasswordsInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"Empty", ""},
+		{"Plain text", "password\n123456\n"},
+		{"Short hash", "5BAA61E4C9B93F3F0682250B6CF8331B7EE68F:3\n"},
+		{"No count", "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pwned.txt")
+			err := os.WriteFile(path, []byte(tt.contents), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			breached, err := OpenBreachedPasswords(path)
+			if err == nil {
+				breached.Close()
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	_, err := OpenBreachedPasswords(filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,241 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	// loginFailureWindow is how long a failed sign in attempt is remembered.
+	// Once this long has passed since the last failure, the count restarts.
+	loginFailureWindow = 24 * time.Hour
+	// loginDelayFreeAttempts is how many consecutive failures an account can
+	// have before each further attempt is delayed.
+	loginDelayFreeAttempts = 3
+	// loginDelayMax is the longest delay between attempts, however many
+	// failures there have been.
+	loginDelayMax = 30 * time.Second
+)
+
+// LockoutPolicy decides when repeated failed sign in attempts lock out an
+// account or a source IP address, and for how long.
+type LockoutPolicy struct {
+	Threshold   int
+	IPThreshold int
+	Duration    time.Duration
+}
+
+// LoginFailures records consecutive failed sign in attempts against an
+// account or from an IP address.
+type LoginFailures struct {
+	Count        int        `json:"failed_login_attempts,omitempty"`
+	LastFailedAt *time.Time `json:"-"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+}
+
+// LockedFor returns how much longer the lockout lasts at now, or zero if there
+// is none.
+func (f LoginFailures) LockedFor(now time.Time) time.Duration {
+	if f.LockedUntil == nil || !f.LockedUntil.After(now) {
+		return 0
+	}
+
+	return f.LockedUntil.Sub(now)
+}
+
+// DelayedFor returns how much longer must pass at now before another attempt
+// is allowed. After loginDelayFreeAttempts failures, the delay starts at one
+// second and doubles with each further failure, up to loginDelayMax.
+func (f LoginFailures) DelayedFor(now time.Time) time.Duration {
+	if f.LastFailedAt == nil || f.Count < loginDelayFreeAttempts {
+		return 0
+	}
+
+	delay := loginDelayMax
+	if shift := f.Count - loginDelayFreeAttempts; shift < 5 {
+		delay = time.Second << shift
+	}
+
+	next := f.LastFailedAt.Add(delay)
+	if !next.After(now) {
+		return 0
+	}
+
+	return next.Sub(now)
+}
+
+// RecordLoginFailure counts a failed sign in attempt against the given user
+// and returns their updated failures. Once the count reaches the policy's
+// threshold, the account is locked for the policy's duration, and each further
+// failure after the lockout ends locks it again. locked reports whether this
+// failure started a new lockout.
+func (m UserModel) RecordLoginFailure(userID int64, policy LockoutPolicy) (f LoginFailures, locked bool, err error) {
+	query := `
+		with failures as (
+		     select id, locked_until,
+		            case when last_failed_login_at is null
+		                   or last_failed_login_at <= $3
+		                 then 1
+		                 else failed_login_count + 1
+		             end as count
+		       from users
+		      where id = $1
+		        for update
+		)
+		update users
+		   set failed_login_count = failures.count,
+		       last_failed_login_at = $2,
+		       locked_until = case when failures.count >= $4
+		                            and (failures.locked_until is null or failures.locked_until <= $2)
+		                           then $5
+		                           else failures.locked_until
+		                       end
+		  from failures
+		 where users.id = failures.id
+	 returning users.failed_login_count, users.last_failed_login_at,
+	           users.locked_until,
+	           failures.count >= $4
+	           and (failures.locked_until is null or failures.locked_until <= $2)
+	`
+
+	now := time.Now()
+	args := []any{
+		userID,
+		now,
+		now.Add(-loginFailureWindow),
+		policy.Threshold,
+		now.Add(policy.Duration),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&f.Count,
+		&f.LastFailedAt,
+		&f.LockedUntil,
+		&locked,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return f, false, ErrRecordNotFound
+		default:
+			return f, false, err
+		}
+	}
+
+	return f, locked, nil
+}
+
+// ResetLoginFailures clears the given user's failed sign in attempts and any
+// lockout, after a successful sign in or when an administrator unlocks them.
+func (m UserModel) ResetLoginFailures(userID int64) error {
+	query := `
+		update users
+		   set failed_login_count = 0, last_failed_login_at = null,
+		       locked_until = null
+		 where id = $1
+		   and (failed_login_count > 0 or locked_until is not null)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// LoginFailureModel tracks failed sign in attempts by source IP address, so
+// that an attacker trying passwords against many accounts is also stopped.
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// Get returns the failures from the given IP address, which are empty if
+// there have been none.
+func (m LoginFailureModel) Get(ip string) (LoginFailures, error) {
+	query := `
+		select failed_login_count, last_failed_login_at, locked_until
+		  from ip_login_failures
+		 where ip = $1
+	`
+
+	var f LoginFailures
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, ip).Scan(&f.Count, &f.LastFailedAt, &f.LockedUntil)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// RecordFailure counts a failed sign in attempt from the given IP address.
+// Once the count reaches the policy's IP threshold, the address is locked out
+// for the policy's duration.
+func (m LoginFailureModel) RecordFailure(ip string, policy LockoutPolicy) error {
+	query := `
+		insert into ip_login_failures as f (ip, failed_login_count, last_failed_login_at)
+		values ($1, 1, $2)
+		    on conflict (ip) do update
+		   set failed_login_count = case
+		           when f.last_failed_login_at <= $3 then 1
+		           else f.failed_login_count + 1
+		       end,
+		       last_failed_login_at = $2,
+		       locked_until = case
+		           when f.failed_login_count + 1 >= $4
+		            and f.last_failed_login_at > $3
+		            and (f.locked_until is null or f.locked_until <= $2)
+		           then $5
+		           else f.locked_until
+		       end
+	`
+
+	now := time.Now()
+	args := []any{
+		ip,
+		now,
+		now.Add(-loginFailureWindow),
+		policy.IPThreshold,
+		now.Add(policy.Duration),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// DeleteStale deletes up to limit IP addresses whose failures have been
+// forgotten and which are not locked out, and returns the number deleted.
+func (m LoginFailureModel) DeleteStale(limit int) (int64, error) {
+	query := `
+		delete from ip_login_failures
+		 where ip in (
+		       select ip from ip_login_failures
+		        where last_failed_login_at <= $1
+		          and (locked_until is null or locked_until <= $2)
+		        limit $3
+		 )
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	result, err := m.DB.ExecContext(ctx, query, now.Add(-loginFailureWindow), now, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
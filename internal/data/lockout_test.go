@@ -0,0 +1,62 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginFailuresDelayedFor(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	justNow := now.Add(-500 * time.Millisecond)
+
+	tests := []struct {
+		name     string
+		failures LoginFailures
+		want     time.Duration
+	}{
+		{"No failures", LoginFailures{}, 0},
+		{"Free attempts", LoginFailures{Count: loginDelayFreeAttempts - 1, LastFailedAt: &justNow}, 0},
+		{"First delay", LoginFailures{Count: loginDelayFreeAttempts, LastFailedAt: &justNow}, 500 * time.Millisecond},
+		{"Doubled delay", LoginFailures{Count: loginDelayFreeAttempts + 2, LastFailedAt: &justNow}, 3500 * time.Millisecond},
+		{"Maximum delay", LoginFailures{Count: loginDelayFreeAttempts + 5, LastFailedAt: &justNow}, loginDelayMax - 500*time.Millisecond},
+		{"Many failures", LoginFailures{Count: 1000, LastFailedAt: &justNow}, loginDelayMax - 500*time.Millisecond},
+		{"Delay passed", LoginFailures{Count: loginDelayFreeAttempts + 5, LastFailedAt: ptr(now.Add(-loginDelayMax))}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.failures.DelayedFor(now)
+			if got != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginFailuresLockedFor(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		lockedUntil *time.Time
+		want        time.Duration
+	}{
+		{"Not locked", nil, 0},
+		{"Locked", ptr(now.Add(15 * time.Minute)), 15 * time.Minute},
+		{"Lockout ending now", ptr(now), 0},
+		{"Lockout ended", ptr(now.Add(-time.Minute)), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := LoginFailures{Count: 10, LockedUntil: tt.lockedUntil}.LockedFor(now)
+			if got != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,329 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/m5lapp/go-service-toolkit/validator"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// totpPeriod is the number of seconds that each TOTP code is valid for.
+	totpPeriod = 30
+	// totpSkew is the number of periods either side of the current one whose
+	// codes are also accepted, to allow for clock drift.
+	totpSkew = 1
+	// recoveryCodeCount is how many recovery codes are issued to a user.
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication already enabled")
+	ErrMFANotConfigured  = errors.New("two-factor authentication is not configured")
+)
+
+var totpOpts = totp.ValidateOpts{
+	Period:    totpPeriod,
+	Skew:      totpSkew,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// TOTP is a user's time-based one-time password (RFC 6238) enrollment. It is
+// only used to authenticate once it has been confirmed.
+type TOTP struct {
+	UserID       int64
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+}
+
+// Confirmed reports whether the user has proved that they can generate codes
+// for the secret.
+func (t *TOTP) Confirmed() bool {
+	return t.ConfirmedAt != nil
+}
+
+// Verify checks code against the codes for the time steps around now and
+// returns the step that it matched. Codes for steps at or before the last
+// used step are rejected so that a code cannot be replayed.
+func (t *TOTP) Verify(code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+
+	for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+		step := current + offset
+		if step <= t.LastUsedStep {
+			continue
+		}
+
+		expected, err := totp.GenerateCodeCustom(t.Secret, time.Unix(step*totpPeriod, 0), totpOpts)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// GenerateTOTPKey creates a new random TOTP key for the given account.
+func GenerateTOTPKey(issuer, accountName string) (*otp.Key, error) {
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: accountName,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+}
+
+func ValidateMFACode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) <= 32, "code", "must not be more than 32 bytes long")
+}
+
+// GenerateRecoveryCodes creates a new set of random single-use recovery codes
+// in the form "xxxxx-xxxxx".
+func GenerateRecoveryCodes() ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
+
+// recoveryCodeHash normalises a recovery code as typed by a user and hashes
+// it.
+func recoveryCodeHash(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+	if len(code) == 10 {
+		code = code[:5] + "-" + code[5:]
+	}
+
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// MFAModel stores users' second factors. TOTP secrets are encrypted with Box,
+// which is nil if no MFA master key has been configured.
+type MFAModel struct {
+	DB  *sql.DB
+	Box *SecretBox
+}
+
+// Enroll stores a new, unconfirmed TOTP secret and set of recovery codes for
+// the given user, replacing any previous unconfirmed enrollment. If the user
+// already has confirmed TOTP enrollment, ErrMFAAlreadyEnabled is returned.
+func (m MFAModel) Enroll(userID int64, secret string, recoveryCodes []string) error {
+	if m.Box == nil {
+		return ErrMFANotConfigured
+	}
+
+	encrypted, err := m.Box.Encrypt([]byte(secret))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		insert into user_totp (user_id, secret)
+		values ($1, $2)
+		    on conflict (user_id) do update
+		   set secret = excluded.secret, created_at = now(), last_used_step = 0
+		 where user_totp.confirmed_at is null
+	`
+
+	result, err := tx.ExecContext(ctx, query, userID, encrypted)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrMFAAlreadyEnabled
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		query = `insert into user_recovery_codes (user_id, hash) values ($1, $2)`
+
+		_, err = tx.ExecContext(ctx, query, userID, recoveryCodeHash(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetTOTP retrieves and decrypts the given user's TOTP enrollment. If the user
+// has not enrolled, ErrRecordNotFound is returned.
+func (m MFAModel) GetTOTP(userID int64) (*TOTP, error) {
+	query := `
+		select user_id, secret, confirmed_at, last_used_step
+		  from user_totp
+		 where user_id = $1
+	`
+
+	var t TOTP
+	var encrypted []byte
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&t.UserID,
+		&encrypted,
+		&t.ConfirmedAt,
+		&t.LastUsedStep,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if m.Box == nil {
+		return nil, ErrMFANotConfigured
+	}
+
+	secret, err := m.Box.Decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	t.Secret = string(secret)
+
+	return &t, nil
+}
+
+// IsEnabled reports whether the given user has confirmed TOTP enrollment, and
+// so must provide a second factor to sign in.
+func (m MFAModel) IsEnabled(userID int64) (bool, error) {
+	query := `
+		select exists (
+		       select 1 from user_totp
+		        where user_id = $1 and confirmed_at is not null
+		)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var enabled bool
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// UseTOTPStep records that the code for the given time step has been used by
+// the given user, confirming their enrollment if necessary. It reports false
+// if a code for the same or a later step has already been used.
+func (m MFAModel) UseTOTPStep(userID, step int64) (bool, error) {
+	query := `
+		update user_totp
+		   set last_used_step = $2, confirmed_at = coalesce(confirmed_at, now())
+		 where user_id = $1
+		   and last_used_step < $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode deletes the given user's recovery code if it exists, so that
+// it can only be used once, and reports whether it did.
+func (m MFAModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `delete from user_recovery_codes where user_id = $1 and hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, recoveryCodeHash(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Disable deletes the given user's TOTP enrollment and recovery codes.
+func (m MFAModel) Disable(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_totp where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
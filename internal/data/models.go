@@ -11,15 +11,55 @@ var (
 )
 
 type Models struct {
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	LoginFailures LoginFailureModel
+	MFA           MFAModel
+	Permissions   PermissionModel
+	Roles         RoleModel
+	Services      ServiceModel
+	Tokens        TokenModel
+	Users         UserModel
+	WebAuthn      WebAuthnModel
+}
+
+// nullableID converts a zero database ID into nil so that it is stored as a
+// null value.
+func nullableID(id int64) any {
+	if id == 0 {
+		return nil
+	}
+
+	return id
+}
+
+// nullableString converts an empty string into nil so that it is stored as a
+// null value.
+func nullableString(s string) any {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+// nullableBytes converts an empty byte slice into nil so that it is stored as
+// a null value.
+func nullableBytes(b []byte) any {
+	if len(b) == 0 {
+		return nil
+	}
+
+	return b
 }
 
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		LoginFailures: LoginFailureModel{DB: db},
+		MFA:           MFAModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		Services:      ServiceModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Users:         UserModel{DB: db},
+		WebAuthn:      WebAuthnModel{DB: db},
 	}
 }
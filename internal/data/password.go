@@ -1,34 +1,113 @@
 package data
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/m5lapp/go-service-toolkit/validator"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// maxPasswordLength limits the work done hashing a password. Unlike bcrypt,
+// argon2id does not truncate long passwords.
+const maxPasswordLength = 256
+
+// minArgon2KeyLength is the shortest argon2id key that a stored hash may have.
+const minArgon2KeyLength = 16
+
+// maxArgon2Factor limits how many times more memory, iterations and lanes than
+// the current parameters a stored hash may use. Matching a hash with much more
+// costly parameters would tie up a request for a long time.
+const maxArgon2Factor = 4
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// Argon2Params are the argon2id parameters used to hash passwords. Memory is
+// in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation of 19 MiB of memory and
+// two iterations.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
 // The password struct represents a password.
 type password struct {
-	plaintext *string
-	hash      []byte
+	plaintext   *string
+	hash        []byte
+	needsRehash bool
 }
 
 // Set generates the hash of the provided plaintextPassword and sets the
 // plaintext and hash values of the password struct to the appropriate values.
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 14)
+// The hash is an argon2id hash in PHC string format, using the given params.
+func (p *password) Set(plaintextPassword string, params Argon2Params) error {
+	salt := make([]byte, params.SaltLength)
+
+	_, err := rand.Read(salt)
 	if err != nil {
 		return err
 	}
 
+	key := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations,
+		params.Memory, params.Parallelism, params.KeyLength)
+
+	encoding := base64.RawStdEncoding
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key))
+
 	p.plaintext = &plaintextPassword
-	p.hash = hash
+	p.hash = []byte(hash)
+	p.needsRehash = false
 
 	return nil
 }
 
-// Matches compares a plaintext password with its hash.
-func (p *password) Matches(plaintextPassword string) (bool, error) {
+// Matches compares a plaintext password with its hash. An empty hash never
+// matches any password. Legacy bcrypt hashes are still accepted, but a
+// successful match against one, or against an argon2id hash whose parameters
+// differ from the current params, flags the password for rehashing.
+func (p *password) Matches(plaintextPassword string, current Argon2Params) (bool, error) {
+	if len(p.hash) == 0 {
+		return false, nil
+	}
+
+	if strings.HasPrefix(string(p.hash), "$argon2id$") {
+		params, salt, key, err := decodeArgon2Hash(string(p.hash), current)
+		if err != nil {
+			return false, err
+		}
+
+		otherKey := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations,
+			params.Memory, params.Parallelism, params.KeyLength)
+
+		if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+			return false, nil
+		}
+
+		params.SaltLength = uint32(len(salt))
+		p.needsRehash = params != current
+
+		return true, nil
+	}
+
 	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
 	if err != nil {
 		switch {
@@ -39,14 +118,69 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 		}
 	}
 
+	p.needsRehash = true
+
 	return true, nil
 }
 
-// ValidatePasswordPlaintext ensures that a provided password satisfies the
-// desired password requirements. Any violations will be added to the given
-// validator.Validator under the "password" key.
+// NeedsRehash reports whether the last successful call to Matches found that
+// the hash should be replaced by calling Set with the same plaintext.
+func (p *password) NeedsRehash() bool {
+	return p.needsRehash
+}
+
+// decodeArgon2Hash parses an argon2id hash in PHC string format. Hashes whose
+// parameters exceed the current ones by more than maxArgon2Factor are rejected.
+func decodeArgon2Hash(hash string, current Argon2Params) (params Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	// argon2 panics without at least one iteration and lane, and needs at
+	// least 8 KiB of memory per lane.
+	if params.Iterations < 1 || params.Parallelism < 1 || params.Memory < 8*uint32(params.Parallelism) {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	if uint64(params.Memory) > maxArgon2Factor*uint64(current.Memory) ||
+		uint64(params.Iterations) > maxArgon2Factor*uint64(current.Iterations) ||
+		uint64(params.Parallelism) > maxArgon2Factor*uint64(current.Parallelism) {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	// An empty key would match every password, as would a very short one
+	// with little effort.
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < minArgon2KeyLength {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// ValidatePasswordPlaintext ensures that a provided password is present and
+// not too long to hash. Any violations will be added to the given
+// validator.Validator under the "password" key. New passwords must also satisfy
+// a PasswordPolicy.
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= maxPasswordLength, "password", "must not be more than 256 bytes long")
 }
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/m5lapp/go-service-toolkit/validator"
+)
+
+// minPersonalInputLength is the shortest part of a user's email address or
+// name that a password must not contain, so that short names do not rule out
+// too many passwords.
+const minPersonalInputLength = 3
+
+// PasswordPolicy decides whether a new password is acceptable.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters in a password.
+	MinLength int
+	// MinClasses is the minimum number of character classes, out of lower case
+	// letters, upper case letters, digits and symbols, that a password must
+	// contain.
+	MinClasses int
+	// MinStrength is the minimum score from PasswordStrength, from 0 to 4.
+	MinStrength int
+	// Breached passwords are rejected if it is not nil.
+	Breached *BreachedPasswords
+}
+
+// DefaultPasswordPolicy requires passwords that are at least 8 characters long
+// and not too easy to guess.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:   8,
+	MinClasses:  0,
+	MinStrength: 2,
+}
+
+// Validate checks that a new password for user satisfies the policy. Any
+// violations will be added to the given validator.Validator under the
+// "password" key. The user may be nil if they are not known yet.
+func (p PasswordPolicy) Validate(v *validator.Validator, password string, user *User) {
+	ValidatePasswordPlaintext(v, password)
+
+	length := utf8.RuneCountInString(password)
+	v.Check(length >= p.MinLength, "password",
+		fmt.Sprintf("must be at least %d characters long", p.MinLength))
+
+	v.Check(characterClasses(password) >= p.MinClasses, "password",
+		fmt.Sprintf("must contain at least %d of lower case letters, upper case letters, digits and symbols", p.MinClasses))
+
+	// The remaining checks are more expensive, so are skipped if the password
+	// has already been rejected.
+	if _, ok := v.Errors["password"]; ok {
+		return
+	}
+
+	inputs := personalInputs(user)
+	lower := strings.ToLower(password)
+
+	for _, input := range inputs {
+		if strings.Contains(lower, input) {
+			v.AddError("password", "must not contain your email address or name")
+			return
+		}
+	}
+
+	if p.Breached != nil {
+		// If the breached password file cannot be read, the password is
+		// allowed rather than stopping every user from changing theirs.
+		breached, err := p.Breached.Contains(password)
+		if err == nil && breached {
+			v.AddError("password", "has appeared in a data breach and must not be used")
+			return
+		}
+	}
+
+	v.Check(PasswordStrength(password, inputs...) >= p.MinStrength, "password",
+		"is too easy to guess, try adding more words or characters")
+}
+
+// characterClasses returns how many of lower case letters, upper case letters,
+// digits and symbols password contains.
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
+
+// personalInputs returns the lower cased parts of user's email address and
+// names that a password must not contain.
+func personalInputs(user *User) []string {
+	if user == nil {
+		return nil
+	}
+
+	var inputs []string
+
+	add := func(s string) {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if utf8.RuneCountInString(s) >= minPersonalInputLength {
+			inputs = append(inputs, s)
+		}
+	}
+
+	add(user.Email)
+	if local, _, found := strings.Cut(user.Email, "@"); found {
+		add(local)
+	}
+
+	names := []string{user.Name}
+	if user.FriendlyName != nil {
+		names = append(names, *user.FriendlyName)
+	}
+
+	for _, name := range names {
+		add(name)
+		for _, part := range strings.Fields(name) {
+			add(part)
+		}
+	}
+
+	return inputs
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m5lapp/go-service-toolkit/validator"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	friendlyName := "Ally"
+	user := &User{Email: "alice.liddell@example.com", Name: "Alice Liddell", FriendlyName: &friendlyName}
+
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	err := os.WriteFile(path, []byte(breachLine("Tr0ub4dor&3")+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breached, err := OpenBreachedPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer breached.Close()
+
+	policy := PasswordPolicy{MinLength: 10, MinClasses: 3, MinStrength: 3, Breached: breached}
+
+	tests := []struct {
+		name     string
+		password string
+		user     *User
+		wantErr  string
+	}{
+		{"Valid", "kT9#vQ2!mZ7$wB", user, ""},
+		{"Empty", "", user, "must be provided"},
+		{"Too long", strings.Repeat("aB3!", 65), user, "must not be more than 256 bytes long"},
+		{"Too short", "aB3!aB3!", user, "must be at least 10 characters long"},
+		{"Too few classes", "correcthorsebatterystaple", user, "must contain at least 3 of"},
+		{"Email address", "Xz9!alice.liddell", user, "must not contain your email address or name"},
+		{"Name part", "Liddell-1865!", user, "must not contain your email address or name"},
+		{"Unknown user", "Qx7!Alice-Zp9", nil, ""},
+		{"Breached", "Tr0ub4dor&3", user, "has appeared in a data breach"},
+		{"Guessable", "Password2024!", user, "is too easy to guess"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			policy.Validate(v, tt.password, tt.user)
+
+			got := v.Errors["password"]
+			switch {
+			case tt.wantErr == "" && got != "":
+				t.Errorf("got error %q; want none", got)
+			case tt.wantErr != "" && !strings.HasPrefix(got, tt.wantErr):
+				t.Errorf("got error %q; want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPersonalInputs(t *testing.T) {
+	friendlyName := "Al"
+	user := &User{Email: "Alice@Example.com", Name: "Alice Mary Liddell", FriendlyName: &friendlyName}
+
+	got := personalInputs(user)
+	want := []string{"alice@example.com", "alice", "alice mary liddell", "alice", "mary", "liddell"}
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	if personalInputs(nil) != nil {
+		t.Error("got inputs for a nil user")
+	}
+}
+
+func TestValidateUserPolicy(t *testing.T) {
+	user := &User{Email: "alice@example.com", Name: "Alice Liddell"}
+
+	err := user.Password.Set("kT9#vQ2!mZ7$wB", DefaultArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := validator.New()
+	ValidateUser(v, user, DefaultPasswordPolicy)
+	if !v.Valid() {
+		t.Errorf("got errors %v; want none", v.Errors)
+	}
+
+	v = validator.New()
+	ValidateUser(v, user, PasswordPolicy{MinLength: 20})
+	if !strings.HasPrefix(v.Errors["password"], "must be at least 20 characters long") {
+		t.Errorf("got password error %q", v.Errors["password"])
+	}
+}
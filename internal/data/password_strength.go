@@ -0,0 +1,234 @@
+package data
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// maxPatternLength is the longest substring of a password that is matched
+// against patterns when estimating its strength.
+const maxPatternLength = 40
+
+// commonPasswords are frequently used passwords and words, most common first.
+// A password made up of these is among the first that an attacker will try.
+var commonPasswords = []string{
+	"password", "qwerty", "letmein", "welcome", "monkey", "dragon", "football",
+	"baseball", "iloveyou", "admin", "login", "master", "sunshine", "princess",
+	"shadow", "superman", "batman", "trustno", "starwars", "whatever", "freedom",
+	"secret", "hello", "charlie", "michael", "jennifer", "hunter", "ashley",
+	"jordan", "thomas", "robert", "daniel", "andrew", "joshua", "jessica",
+	"matthew", "pepper", "ginger", "cookie", "cheese", "chocolate", "summer",
+	"winter", "spring", "autumn", "monday", "friday", "january", "december",
+	"computer", "internet", "soccer", "hockey", "killer", "mustang", "ranger",
+	"buster", "tigger", "harley", "maggie", "bailey", "flower", "purple",
+	"orange", "yellow", "silver", "golden", "diamond", "angel", "lovely",
+	"love", "loveme", "family", "forever", "heaven", "banana", "apple",
+	"access", "changeme", "default", "guest", "root", "user", "test", "testing",
+	"qwertyuiop", "asdfgh", "zxcvbn", "passwd", "pass", "god", "jesus",
+	"london", "paris", "america", "canada", "pokemon", "naruto",
+	"liverpool", "chelsea", "arsenal", "yankees", "cowboys", "eagles",
+	"money", "dollar", "online", "secure", "private", "system", "server",
+	"office", "company", "business", "service", "account",
+}
+
+// commonPasswordRanks maps each common password to its rank in the list.
+var commonPasswordRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, p := range commonPasswords {
+		ranks[p] = i + 1
+	}
+	return ranks
+}()
+
+// keyboardRows are runs of adjacent keys on a QWERTY keyboard.
+var keyboardRows = []string{"qwertyuiop", "asdfghjkl", "zxcvbnm", "1qaz", "2wsx", "3edc"}
+
+// leetSubstitutions undo common substitutions of letters with lookalikes.
+var leetSubstitutions = strings.NewReplacer(
+	"@", "a", "4", "a", "8", "b", "(", "c", "3", "e", "6", "g", "1", "i",
+	"!", "i", "0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z",
+)
+
+// PasswordStrength estimates how hard a password is to guess, in the manner of
+// zxcvbn. The password is split into the sequence of common words, repeated
+// characters, sequences, keyboard runs, years and other characters that needs
+// the fewest guesses to find, and the total is scored from 0 (too guessable)
+// to 4 (very unguessable). Any userInputs, such as the user's name, are
+// treated as the most common words of all.
+func PasswordStrength(password string, userInputs ...string) int {
+	ranks := commonPasswordRanks
+	if len(userInputs) > 0 {
+		ranks = make(map[string]int, len(commonPasswordRanks)+len(userInputs))
+		for word, rank := range commonPasswordRanks {
+			ranks[word] = rank + len(userInputs)
+		}
+		for i, input := range userInputs {
+			ranks[strings.ToLower(input)] = i + 1
+		}
+	}
+
+	runes := []rune(password)
+
+	// best[i] is the base 10 logarithm of the fewest guesses needed to find
+	// the first i characters of the password.
+	best := make([]float64, len(runes)+1)
+
+	for i := 1; i <= len(runes); i++ {
+		best[i] = math.Inf(1)
+		for j := i - 1; j >= 0 && i-j <= maxPatternLength; j-- {
+			guesses := best[j] + math.Log10(patternGuesses(runes[j:i], ranks))
+			if guesses < best[i] {
+				best[i] = guesses
+			}
+		}
+	}
+
+	switch guesses := best[len(runes)]; {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// patternGuesses estimates the number of guesses needed to find s on its own,
+// using the pattern that needs the fewest.
+func patternGuesses(s []rune, ranks map[string]int) float64 {
+	if len(s) == 1 {
+		return float64(cardinality(s[0]))
+	}
+
+	// Guessing each character in turn is always possible.
+	guesses := 1.0
+	for _, r := range s {
+		guesses *= float64(cardinality(r))
+	}
+
+	if len(s) >= 3 {
+		guesses = math.Min(guesses, dictionaryGuesses(string(s), ranks))
+		guesses = math.Min(guesses, repeatGuesses(s))
+		guesses = math.Min(guesses, sequenceGuesses(s))
+	}
+
+	if len(s) >= 4 {
+		guesses = math.Min(guesses, keyboardGuesses(string(s)))
+		guesses = math.Min(guesses, yearGuesses(string(s)))
+	}
+
+	return guesses
+}
+
+// cardinality returns the number of characters in r's character class.
+func cardinality(r rune) int {
+	switch {
+	case r >= '0' && r <= '9':
+		return 10
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return 26
+	case r < unicode.MaxASCII:
+		return 33
+	default:
+		return 100
+	}
+}
+
+// dictionaryGuesses returns the rank of s as a common word, doubled if it is
+// capitalised or uses lookalike characters, or +Inf if it is not one.
+func dictionaryGuesses(s string, ranks map[string]int) float64 {
+	lower := strings.ToLower(s)
+
+	variations := 1.0
+	if lower != s {
+		variations *= 2
+	}
+
+	if rank, ok := ranks[lower]; ok {
+		return float64(rank) * variations
+	}
+
+	if rank, ok := ranks[leetSubstitutions.Replace(lower)]; ok {
+		return float64(rank) * variations * 2
+	}
+
+	return math.Inf(1)
+}
+
+// repeatGuesses returns the guesses needed for s if it is a single repeated
+// character, or +Inf if it is not.
+func repeatGuesses(s []rune) float64 {
+	for _, r := range s[1:] {
+		if r != s[0] {
+			return math.Inf(1)
+		}
+	}
+
+	return float64(cardinality(s[0]) * len(s))
+}
+
+// sequenceGuesses returns the guesses needed for s if it is a run of
+// consecutive characters such as "abcd" or "9876", or +Inf if it is not.
+func sequenceGuesses(s []rune) float64 {
+	delta := s[1] - s[0]
+	if delta != 1 && delta != -1 {
+		return math.Inf(1)
+	}
+
+	for i := 2; i < len(s); i++ {
+		if s[i]-s[i-1] != delta || cardinality(s[i]) != cardinality(s[0]) {
+			return math.Inf(1)
+		}
+	}
+
+	// Sequences starting at an obvious character are tried first.
+	start := float64(cardinality(s[0]))
+	switch unicode.ToLower(s[0]) {
+	case 'a', 'z', '0', '1', '9':
+		start = 4
+	}
+
+	if delta < 0 {
+		start *= 2
+	}
+
+	return start * float64(len(s))
+}
+
+// keyboardGuesses returns the guesses needed for s if it is a run of adjacent
+// keys, or +Inf if it is not.
+func keyboardGuesses(s string) float64 {
+	lower := strings.ToLower(s)
+
+	for _, row := range keyboardRows {
+		if strings.Contains(row, lower) || strings.Contains(reverse(row), lower) {
+			return float64(40 * len(s))
+		}
+	}
+
+	return math.Inf(1)
+}
+
+// yearGuesses returns the guesses needed for s if it is a recent year, or +Inf
+// if it is not.
+func yearGuesses(s string) float64 {
+	if len(s) == 4 && (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) &&
+		strings.Trim(s, "0123456789") == "" {
+		return 120
+	}
+
+	return math.Inf(1)
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -0,0 +1,41 @@
+package data
+
+import "testing"
+
+func TestPasswordStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"password", 0},
+		{"P@ssw0rd", 0},
+		{"password2024", 0},
+		{"qwertyuiop", 0},
+		{"abcdefgh", 0},
+		{"aaaaaaaaaaaa", 0},
+		{"19841984", 1},
+		{"correct horse battery staple", 4},
+		{"purple-monkey-dishwasher", 4},
+		{"kT9#vQ2!mZ7$wB", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			got := PasswordStrength(tt.password)
+			if got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordStrengthUserInputs(t *testing.T) {
+	if got := PasswordStrength("wonderland1987"); got < 3 {
+		t.Fatalf("got %d without user inputs; want at least 3", got)
+	}
+
+	if got := PasswordStrength("Wonderland1987", "alice", "wonderland"); got != 0 {
+		t.Errorf("got %d with a user input; want 0", got)
+	}
+}
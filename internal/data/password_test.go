@@ -0,0 +1,172 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordMatches(t *testing.T) {
+	var p password
+
+	err := p.Set("correct horse battery staple", DefaultArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(p.hash), "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("got hash %q", p.hash)
+	}
+
+	ok, err := p.Matches("correct horse battery staple", DefaultArgon2Params)
+	if err != nil || !ok {
+		t.Errorf("got %t, %v; want a match", ok, err)
+	}
+	if p.NeedsRehash() {
+		t.Error("hash created with the current parameters needs rehashing")
+	}
+
+	ok, err = p.Matches("Correct horse battery staple", DefaultArgon2Params)
+	if err != nil || ok {
+		t.Errorf("got %t, %v; want no match", ok, err)
+	}
+
+	var other password
+	err = other.Set("correct horse battery staple", DefaultArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(other.hash) == string(p.hash) {
+		t.Error("hashes of the same password are the same")
+	}
+}
+
+func TestPasswordMatchesEmptyHash(t *testing.T) {
+	var p password
+
+	ok, err := p.Matches("", DefaultArgon2Params)
+	if err != nil || ok {
+		t.Errorf("got %t, %v; want no match", ok, err)
+	}
+}
+
+func TestPasswordMatchesBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pa55word"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := password{hash: hash}
+
+	ok, err := p.Matches("pa55w0rd", DefaultArgon2Params)
+	if err != nil || ok || p.NeedsRehash() {
+		t.Errorf("got %t, %v, rehash %t; want no match", ok, err, p.NeedsRehash())
+	}
+
+	ok, err = p.Matches("pa55word", DefaultArgon2Params)
+	if err != nil || !ok {
+		t.Errorf("got %t, %v; want a match", ok, err)
+	}
+	if !p.NeedsRehash() {
+		t.Error("bcrypt hash does not need rehashing")
+	}
+}
+
+func TestPasswordMatchesChangedParams(t *testing.T) {
+	old := DefaultArgon2Params
+	old.Memory = 8 * 1024
+	old.Iterations = 1
+
+	var p password
+	err := p.Set("pa55word", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := p.Matches("pa55word", DefaultArgon2Params)
+	if err != nil || !ok {
+		t.Errorf("got %t, %v; want a match", ok, err)
+	}
+	if !p.NeedsRehash() {
+		t.Error("hash created with old parameters does not need rehashing")
+	}
+
+	// A failed match leaves the hash's rehash flag alone.
+	p.needsRehash = false
+	ok, _ = p.Matches("wrong", DefaultArgon2Params)
+	if ok || p.NeedsRehash() {
+		t.Error("failed match flagged the hash for rehashing")
+	}
+}
+
+func TestDecodeArgon2Hash(t *testing.T) {
+	salt := "c29tZXNhbHRzb21lc2FsdA"
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	params, _, _, err := decodeArgon2Hash("$argon2id$v=19$m=19456,t=2,p=1$"+salt+"$"+key, DefaultArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Argon2Params{Memory: 19456, Iterations: 2, Parallelism: 1, KeyLength: 29}
+	if params != want {
+		t.Errorf("got %+v; want %+v", params, want)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"Too few parts", "$argon2id$v=19$m=19456,t=2,p=1$" + salt},
+		{"Too many parts", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + key + "$"},
+		{"Other version", "$argon2id$v=16$m=19456,t=2,p=1$" + salt + "$" + key},
+		{"Bad params", "$argon2id$v=19$m=lots,t=2,p=1$" + salt + "$" + key},
+		{"No iterations", "$argon2id$v=19$m=19456,t=0,p=1$" + salt + "$" + key},
+		{"No lanes", "$argon2id$v=19$m=19456,t=2,p=0$" + salt + "$" + key},
+		{"Too little memory", "$argon2id$v=19$m=7,t=2,p=1$" + salt + "$" + key},
+		{"Bad salt", "$argon2id$v=19$m=19456,t=2,p=1$not*base64$" + key},
+		{"Bad key", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$not*base64"},
+		{"Empty key", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$"},
+		{"Short key", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$a2V5"},
+		{"Too much memory", "$argon2id$v=19$m=77825,t=2,p=1$" + salt + "$" + key},
+		{"Too many iterations", "$argon2id$v=19$m=19456,t=9,p=1$" + salt + "$" + key},
+		{"Too many lanes", "$argon2id$v=19$m=19456,t=2,p=5$" + salt + "$" + key},
+		{"Huge memory", "$argon2id$v=19$m=4294967295,t=2,p=1$" + salt + "$" + key},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := decodeArgon2Hash(tt.hash, DefaultArgon2Params)
+			if !errors.Is(err, ErrInvalidPasswordHash) {
+				t.Errorf("got %v; want ErrInvalidPasswordHash", err)
+			}
+
+			p := password{hash: []byte(tt.hash)}
+			ok, err := p.Matches("", DefaultArgon2Params)
+			if ok || err == nil {
+				t.Errorf("got %t, %v from Matches; want an error", ok, err)
+			}
+		})
+	}
+}
+
+func TestDecodeArgon2HashLimits(t *testing.T) {
+	salt := "c29tZXNhbHRzb21lc2FsdA"
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	// Up to four times the current memory, iterations and lanes are accepted.
+	_, _, _, err := decodeArgon2Hash("$argon2id$v=19$m=77824,t=8,p=4$"+salt+"$"+key, DefaultArgon2Params)
+	if err != nil {
+		t.Errorf("got %v; want no error", err)
+	}
+
+	// The limits follow the current parameters.
+	current := DefaultArgon2Params
+	current.Memory = 64 * 1024
+	_, _, _, err = decodeArgon2Hash("$argon2id$v=19$m=77825,t=2,p=1$"+salt+"$"+key, current)
+	if err != nil {
+		t.Errorf("got %v; want no error", err)
+	}
+}
@@ -10,6 +10,12 @@ import (
 
 type Permissions []string
 
+// ServicePermissions groups the permission codes owned by a single service.
+type ServicePermissions struct {
+	Service     string      `json:"service"`
+	Permissions Permissions `json:"permissions"`
+}
+
 func (p Permissions) Include(code string) bool {
 	for i := range p {
 		if code == p[i] {
@@ -23,13 +29,20 @@ type PermissionModel struct {
 	DB *sql.DB
 }
 
+// GetAllForUser retrieves the codes of every permission the user holds, either
+// directly or through one of their roles.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 		select permissions.permission
 		  from permissions
 	inner join user_permissions on user_permissions.permission_id = permissions.id
-	inner join users on user_permissions.user_id = users.id
-	     where users.id = $1	
+	     where user_permissions.user_id = $1
+		 union
+		select permissions.permission
+		  from permissions
+	inner join role_permissions on role_permissions.permission_id = permissions.id
+	inner join user_roles on user_roles.role_id = role_permissions.role_id
+	     where user_roles.user_id = $1
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -67,6 +80,7 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 		insert into user_permissions
 		select $1, permissions.id from permissions
 		 where permissions.permission = any($2)
+		    on conflict do nothing
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -75,3 +89,140 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// RemoveForUser revokes the permission with the given code from the user. If
+// the user does not hold the permission, ErrRecordNotFound is returned.
+func (m PermissionModel) RemoveForUser(userID int64, code string) error {
+	query := `
+		delete from user_permissions
+		 using permissions
+		 where user_permissions.permission_id = permissions.id
+		   and user_permissions.user_id = $1
+		   and permissions.permission = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, code)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ListAll returns every permission code, grouped by the service that owns it.
+// Permissions belonging to deleted services are excluded.
+func (m PermissionModel) ListAll() ([]ServicePermissions, error) {
+	query := `
+		select services.name, permissions.permission
+		  from permissions
+	inner join services on permissions.service_id = services.id
+	     where services.deleted = false
+	  order by services.name, permissions.permission
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := []ServicePermissions{}
+
+	for rows.Next() {
+		var service, permission string
+
+		err := rows.Scan(&service, &permission)
+		if err != nil {
+			return nil, err
+		}
+
+		// The rows are ordered by service name, so a new group is only needed
+		// when the service changes.
+		if len(all) == 0 || all[len(all)-1].Service != service {
+			all = append(all, ServicePermissions{Service: service})
+		}
+
+		last := &all[len(all)-1]
+		last.Permissions = append(last.Permissions, permission)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return all, nil
+}
+
+// GetAllForService retrieves the codes of every permission owned by the
+// service with the given ID.
+func (m PermissionModel) GetAllForService(serviceID int64) (Permissions, error) {
+	query := `
+		select permission from permissions
+		 where service_id = $1
+	  order by permission
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// InsertForService creates permissions with the given codes, owned by the
+// service with the given ID. Codes the service already owns are ignored.
+func (m PermissionModel) InsertForService(serviceID int64, codes ...string) error {
+	query := `
+		insert into permissions (service_id, permission)
+		select $1, code from unnest($2::text[]) as code
+		 where not exists (
+		       select 1 from permissions
+		        where service_id = $1 and permission = code
+		 )
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, serviceID, pq.Array(codes))
+	return err
+}
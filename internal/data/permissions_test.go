@@ -0,0 +1,67 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPermissionModel(t *testing.T) {
+	m := newTestModels(t)
+
+	user := insertTestUser(t, m, "alice@example.com", "correct horse battery staple")
+
+	all, err := m.Permissions.ListAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var userService *ServicePermissions
+	for i := range all {
+		if all[i].Service == "user-service" {
+			userService = &all[i]
+		}
+	}
+
+	if userService == nil {
+		t.Fatalf("got %+v; want the user service's permissions", all)
+	}
+	for _, code := range []string{"users:read", "users:write", "permissions:write"} {
+		if !userService.Permissions.Include(code) {
+			t.Errorf("got %v; want it to include %q", userService.Permissions, code)
+		}
+	}
+
+	// Unknown codes and those that the user already holds are ignored.
+	for i := 0; i < 2; i++ {
+		err = m.Permissions.AddForUser(user.ID, "users:read", "users:write", "unknown:code")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	permissions, err := m.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 2 || !permissions.Include("users:read") || !permissions.Include("users:write") {
+		t.Errorf("got permissions %v", permissions)
+	}
+
+	err = m.Permissions.RemoveForUser(user.ID, "users:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Permissions.RemoveForUser(user.ID, "users:write")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v removing a permission that is not held; want ErrRecordNotFound", err)
+	}
+
+	permissions, err = m.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 1 || !permissions.Include("users:read") {
+		t.Errorf("got permissions %v; want only users:read", permissions)
+	}
+}
@@ -0,0 +1,362 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/m5lapp/go-service-toolkit/validator"
+)
+
+var ErrDuplicateRoleName = errors.New("duplicate role name")
+
+// Role represents a named group of permissions that can be assigned to users.
+type Role struct {
+	ID          int64       `json:"id"`
+	Version     int         `json:"-"`
+	CreatedAt   time.Time   `json:"-"`
+	UpdatedAt   time.Time   `json:"-"`
+	Name        string      `json:"name"`
+	Description *string     `json:"description,omitempty"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// ValidateRole checks if a role is considered valid and stores any errors in
+// the provided validator.Validator struct.
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "Must be provided")
+	v.Check(len(role.Name) <= 100, "name", "Must not be more than 100 bytes long")
+
+	if role.Description != nil {
+		l := len(*role.Description) <= 500
+		v.Check(l, "description", "Must not be more than 500 bytes long")
+	}
+}
+
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// Insert adds the given Role into the database. If the name (case insensitive)
+// already exists, then ErrDuplicateRoleName is returned. The role's
+// permissions are not stored, use AddPermissions for that.
+func (m RoleModel) Insert(role *Role) error {
+	query := `
+		insert into roles (name, description)
+		values ($1, $2)
+	 returning id, version, created_at, updated_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, query, role.Name, role.Description)
+	err := row.Scan(&role.ID, &role.Version, &role.CreatedAt, &role.UpdatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	role.Permissions = Permissions{}
+
+	return nil
+}
+
+// Get retrieves the Role with the given ID along with its permissions. If no
+// matching record exists, ErrRecordNotFound is returned.
+func (m RoleModel) Get(id int64) (*Role, error) {
+	query := `
+		select roles.id, roles.version, roles.created_at, roles.updated_at,
+		       roles.name, roles.description,
+		       coalesce(array_agg(permissions.permission order by permissions.permission)
+		                filter (where permissions.id is not null), '{}')
+		  from roles
+	 left join role_permissions on role_permissions.role_id = roles.id
+	 left join permissions on role_permissions.permission_id = permissions.id
+	     where roles.id = $1
+	  group by roles.id
+	`
+
+	var role Role
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&role.ID,
+		&role.Version,
+		&role.CreatedAt,
+		&role.UpdatedAt,
+		&role.Name,
+		&role.Description,
+		pq.Array((*[]string)(&role.Permissions)),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &role, nil
+}
+
+// GetAll retrieves every Role along with its permissions, ordered by name.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+		select roles.id, roles.version, roles.created_at, roles.updated_at,
+		       roles.name, roles.description,
+		       coalesce(array_agg(permissions.permission order by permissions.permission)
+		                filter (where permissions.id is not null), '{}')
+		  from roles
+	 left join role_permissions on role_permissions.role_id = roles.id
+	 left join permissions on role_permissions.permission_id = permissions.id
+	  group by roles.id
+	  order by roles.name
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(
+			&role.ID,
+			&role.Version,
+			&role.CreatedAt,
+			&role.UpdatedAt,
+			&role.Name,
+			&role.Description,
+			pq.Array((*[]string)(&role.Permissions)),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Update updates the name and description of the given Role. If there is an
+// edit conflict and the version number is not the expected one, then
+// ErrEditConflict will be returned.
+func (m RoleModel) Update(role *Role) error {
+	query := `
+		update roles
+		   set version = version + 1, updated_at = now(),
+		       name = $1, description = $2
+		 where id = $3 and version = $4
+		 returning version, updated_at
+	`
+
+	args := []any{role.Name, role.Description, role.ID, role.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&role.Version, &role.UpdatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the Role with the given ID, revoking it from any users that
+// hold it. If no matching record exists, ErrRecordNotFound is returned.
+func (m RoleModel) Delete(id int64) error {
+	query := `delete from roles where id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// AddPermissions grants the permissions with the given codes to the Role.
+// Codes the role already holds are ignored.
+func (m RoleModel) AddPermissions(roleID int64, codes ...string) error {
+	query := `
+		insert into role_permissions
+		select $1, permissions.id from permissions
+		 where permissions.permission = any($2)
+		    on conflict do nothing
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, roleID, pq.Array(codes))
+	return err
+}
+
+// RemovePermission revokes the permission with the given code from the Role.
+// If the role does not hold the permission, ErrRecordNotFound is returned.
+func (m RoleModel) RemovePermission(roleID int64, code string) error {
+	query := `
+		delete from role_permissions
+		 using permissions
+		 where role_permissions.permission_id = permissions.id
+		   and role_permissions.role_id = $1
+		   and permissions.permission = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, roleID, code)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAllForUser retrieves every Role assigned to the given user.
+func (m RoleModel) GetAllForUser(userID int64) ([]*Role, error) {
+	query := `
+		select roles.id, roles.version, roles.created_at, roles.updated_at,
+		       roles.name, roles.description,
+		       coalesce(array_agg(permissions.permission order by permissions.permission)
+		                filter (where permissions.id is not null), '{}')
+		  from roles
+	inner join user_roles on user_roles.role_id = roles.id
+	 left join role_permissions on role_permissions.role_id = roles.id
+	 left join permissions on role_permissions.permission_id = permissions.id
+	     where user_roles.user_id = $1
+	  group by roles.id
+	  order by roles.name
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(
+			&role.ID,
+			&role.Version,
+			&role.CreatedAt,
+			&role.UpdatedAt,
+			&role.Name,
+			&role.Description,
+			pq.Array((*[]string)(&role.Permissions)),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// AddForUser assigns the Role with the given ID to the user. Assigning a role
+// the user already holds is not an error.
+func (m RoleModel) AddForUser(userID, roleID int64) error {
+	query := `
+		insert into user_roles (user_id, role_id)
+		values ($1, $2)
+		    on conflict do nothing
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, roleID)
+	return err
+}
+
+// RemoveForUser revokes the Role with the given ID from the user. If the user
+// does not hold the role, ErrRecordNotFound is returned.
+func (m RoleModel) RemoveForUser(userID, roleID int64) error {
+	query := `delete from user_roles where user_id = $1 and role_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, roleID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestRoleModel(t *testing.T) {
+	m := newTestModels(t)
+
+	user := insertTestUser(t, m, "alice@example.com", "correct horse battery staple")
+
+	role := &Role{Name: "Support"}
+
+	err := m.Roles.Insert(role)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Roles.Insert(&Role{Name: "support"})
+	if !errors.Is(err, ErrDuplicateRoleName) {
+		t.Errorf("got %v inserting a duplicate name; want ErrDuplicateRoleName", err)
+	}
+
+	err = m.Roles.AddPermissions(role.ID, "users:read", "users:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Roles.AddForUser(user.ID, role.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The user's permissions are the union of those they hold directly and
+	// through their roles, without duplicates.
+	err = m.Permissions.AddForUser(user.ID, "users:read", "permissions:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions, err := m.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(permissions)
+	want := Permissions{"permissions:write", "users:read", "users:write"}
+	if !slices.Equal(permissions, want) {
+		t.Errorf("got permissions %v; want %v", permissions, want)
+	}
+
+	roles, err := m.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 || roles[0].Name != "Support" || !slices.Equal(roles[0].Permissions, Permissions{"users:read", "users:write"}) {
+		t.Errorf("got roles %+v", roles)
+	}
+
+	// Changes to the role apply to the users that hold it.
+	err = m.Roles.RemovePermission(role.ID, "users:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Roles.RemovePermission(role.ID, "users:write")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v removing a permission that is not held; want ErrRecordNotFound", err)
+	}
+
+	permissions, err = m.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permissions.Include("users:write") {
+		t.Errorf("got permissions %v after removing users:write from the role", permissions)
+	}
+
+	stale := *role
+
+	role.Name = "Customer support"
+	err = m.Roles.Update(role)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Roles.Update(&stale)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("got %v updating a stale role; want ErrEditConflict", err)
+	}
+
+	// Deleting the role revokes it from its users, leaving their direct
+	// permissions.
+	err = m.Roles.Delete(role.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roles, err = m.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 0 {
+		t.Errorf("got roles %+v after the role was deleted", roles)
+	}
+
+	permissions, err = m.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(permissions)
+	want = Permissions{"permissions:write", "users:read"}
+	if !slices.Equal(permissions, want) {
+		t.Errorf("got permissions %v; want %v", permissions, want)
+	}
+
+	err = m.Roles.RemoveForUser(user.ID, role.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v removing a role that is not held; want ErrRecordNotFound", err)
+	}
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+var (
+	ErrMasterKeyLength = errors.New("master key must be 32 bytes long")
+	ErrDecryption      = errors.New("unable to decrypt secret")
+)
+
+// SecretBox encrypts secrets that must be stored at rest, such as private
+// keys, using AES-256-GCM under a master key.
+type SecretBox struct {
+	gcm cipher.AEAD
+}
+
+// NewSecretBox creates a SecretBox using the given 32 byte master key.
+func NewSecretBox(masterKey []byte) (*SecretBox, error) {
+	if len(masterKey) != 32 {
+		return nil, ErrMasterKeyLength
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretBox{gcm: gcm}, nil
+}
+
+// Encrypt seals plaintext, prefixing the result with the random nonce used.
+func (b *SecretBox) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, b.gcm.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt. If the ciphertext was not
+// produced under the same master key, or has been modified, ErrDecryption is
+// returned.
+func (b *SecretBox) Decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := b.gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, ErrDecryption
+	}
+
+	plaintext, err := b.gcm.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,260 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/m5lapp/go-service-toolkit/validator"
+)
+
+var (
+	ErrDuplicateServiceName = errors.New("duplicate service name")
+
+	// ServiceNameRX matches lower case service names made up of letters,
+	// digits and hyphens, such as "billing-service".
+	ServiceNameRX = regexp.MustCompile("^[a-z0-9]+(-[a-z0-9]+)*$")
+)
+
+// Service represents a machine client of the system, such as a backend job or
+// another microservice.
+type Service struct {
+	ID           int64     `json:"-"`
+	Version      int       `json:"-"`
+	CreatedAt    time.Time `json:"-"`
+	UpdatedAt    time.Time `json:"-"`
+	Name         string    `json:"name"`
+	Description  *string   `json:"description,omitempty"`
+	AdminEmail   *string   `json:"admin_email,omitempty"`
+	Password     password  `json:"-"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Public       bool      `json:"public"`
+	Suspended    bool      `json:"-"`
+}
+
+// HasRedirectURI reports whether uri exactly matches one of the Service's
+// registered OAuth 2.0 redirect URIs.
+func (s *Service) HasRedirectURI(uri string) bool {
+	for i := range s.RedirectURIs {
+		if uri == s.RedirectURIs[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateSecret creates a new random secret for the Service and sets it as
+// the service's password. The plaintext secret is returned so that it can be
+// handed to the service's administrator; it cannot be recovered later. The
+// secret is hashed with the given params.
+func (s *Service) GenerateSecret(params Argon2Params) (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	err = s.Password.Set(secret, params)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// ValidateService checks if a service is considered valid and stores any
+// errors in the provided validator.Validator struct.
+func ValidateService(v *validator.Validator, service *Service) {
+	v.Check(service.Name != "", "name", "Must be provided")
+	v.Check(len(service.Name) <= 100, "name", "Must not be more than 100 bytes long")
+	v.Check(validator.Matches(service.Name, ServiceNameRX), "name",
+		"Must only contain lower case letters, digits and hyphens")
+
+	if service.Description != nil {
+		l := len(*service.Description) <= 500
+		v.Check(l, "description", "Must not be more than 500 bytes long")
+	}
+
+	if service.AdminEmail != nil {
+		validator.ValidateEmail(v, *service.AdminEmail)
+	}
+
+	for _, uri := range service.RedirectURIs {
+		ValidateRedirectURI(v, uri)
+	}
+
+	v.Check(!service.Public || len(service.RedirectURIs) > 0, "redirect_uris",
+		"Must be provided for public clients")
+
+	if service.Password.hash == nil {
+		panic("missing password hash for service")
+	}
+}
+
+// ValidateRedirectURI checks that uri is suitable for registration as an OAuth
+// 2.0 redirect URI. It must be absolute and have no fragment, and plain http
+// is only permitted for loopback addresses. Custom schemes are allowed for
+// native apps. Any violations are stored under the "redirect_uris" key.
+func ValidateRedirectURI(v *validator.Validator, uri string) {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() {
+		v.AddError("redirect_uris", "Must only contain absolute URIs")
+		return
+	}
+
+	v.Check(u.Fragment == "", "redirect_uris", "Must not contain URIs with fragments")
+
+	if u.Scheme == "http" {
+		host := u.Hostname()
+		loopback := host == "localhost" || host == "127.0.0.1" || host == "::1"
+		v.Check(loopback, "redirect_uris", "Must only use http for loopback addresses")
+	}
+}
+
+type ServiceModel struct {
+	DB *sql.DB
+}
+
+// Insert adds the given Service into the database. If the name (case
+// insensitive) already exists, then ErrDuplicateServiceName is returned.
+func (m ServiceModel) Insert(service *Service) error {
+	query := `
+		insert into services (
+			name, description, admin_email, password_hash, redirect_uris,
+			public
+		)
+		values ($1, $2, $3, $4, $5, $6)
+	 returning id, version, created_at, updated_at, suspended
+	`
+
+	if service.RedirectURIs == nil {
+		service.RedirectURIs = []string{}
+	}
+
+	args := []any{
+		service.Name,
+		service.Description,
+		service.AdminEmail,
+		service.Password.hash,
+		pq.Array(service.RedirectURIs),
+		service.Public,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, query, args...)
+	err := row.Scan(&service.ID, &service.Version, &service.CreatedAt, &service.UpdatedAt, &service.Suspended)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "services_name_key"`:
+			return ErrDuplicateServiceName
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetByName retrieves the Service with the given name. If no matching record
+// exists, ErrRecordNotFound is returned.
+func (m ServiceModel) GetByName(name string) (*Service, error) {
+	query := `
+		select id, version, created_at, updated_at, name, description,
+		       admin_email, password_hash, redirect_uris, public, suspended
+		  from services
+		 where name = $1
+		   and deleted = false
+	`
+
+	var service Service
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(
+		&service.ID,
+		&service.Version,
+		&service.CreatedAt,
+		&service.UpdatedAt,
+		&service.Name,
+		&service.Description,
+		&service.AdminEmail,
+		&service.Password.hash,
+		pq.Array(&service.RedirectURIs),
+		&service.Public,
+		&service.Suspended,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &service, nil
+}
+
+// GetForToken retrieves a Service from the database for a given Token. If the
+// token is expired, or the service has been suspended or deleted, then an
+// ErrRecordNotFound error is returned.
+func (m ServiceModel) GetForToken(tokenScope, tokenPlaintext string) (*Service, error) {
+	query := `
+		select services.id, services.version, services.created_at,
+		       services.updated_at, services.name, services.description,
+		       services.admin_email, services.password_hash,
+		       services.redirect_uris, services.public, services.suspended
+		  from services
+	inner join tokens
+	        on services.id = tokens.service_id
+		 where tokens.hash = $1
+		   and tokens.scope = $2
+		   and tokens.expiry > $3
+		   and services.suspended = false
+		   and services.deleted = false
+	`
+
+	var service Service
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	args := []any{tokenHash[:], tokenScope, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&service.ID,
+		&service.Version,
+		&service.CreatedAt,
+		&service.UpdatedAt,
+		&service.Name,
+		&service.Description,
+		&service.AdminEmail,
+		&service.Password.hash,
+		pq.Array(&service.RedirectURIs),
+		&service.Public,
+		&service.Suspended,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &service, nil
+}
@@ -0,0 +1,155 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"time"
+
+	"github.com/m5lapp/go-service-toolkit/validator"
+)
+
+// SessionMetadata describes where a user's session was established. UserAgent
+// and IP are updated as the session is used, while DeviceLabel is an optional
+// name chosen by the user when they signed in.
+type SessionMetadata struct {
+	UserAgent   string
+	IP          string
+	DeviceLabel string
+}
+
+// Session is a user's sign in, made up of every token that shares a session
+// ID. Its ID is not secret and cannot be used to authenticate.
+type Session struct {
+	ID          string     `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	Expiry      time.Time  `json:"expiry"`
+	UserAgent   string     `json:"user_agent,omitempty"`
+	IP          string     `json:"ip,omitempty"`
+	DeviceLabel string     `json:"device_label,omitempty"`
+	Client      string     `json:"client,omitempty"`
+	Current     bool       `json:"current"`
+}
+
+func ValidateDeviceLabel(v *validator.Validator, label string) {
+	v.Check(len(label) <= 100, "device_label", "must not be more than 100 bytes long")
+}
+
+func generateSessionID() (string, error) {
+	randomBytes := make([]byte, 10)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// GetSessionsForUser returns the given user's active sessions, most recently
+// created first. A session's expiry is that of its longest lived token, and
+// used refresh tokens are ignored.
+func (m TokenModel) GetSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+		select id, created_at, last_used_at, expiry, user_agent, ip,
+		       device_label, client
+		  from (
+		select distinct on (tokens.session_id)
+		       tokens.session_id as id, tokens.created_at, tokens.last_used_at,
+		       tokens.expiry, coalesce(tokens.user_agent, '') as user_agent,
+		       coalesce(tokens.ip, '') as ip,
+		       coalesce(tokens.device_label, '') as device_label,
+		       coalesce(services.name, '') as client
+		  from tokens
+	 left join services
+	        on services.id = tokens.client_id
+		 where tokens.user_id = $1
+		   and tokens.session_id is not null
+		   and tokens.used_at is null
+		   and tokens.expiry > now()
+	  order by tokens.session_id, tokens.expiry desc
+		       ) sessions
+	  order by created_at desc
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.DeviceLabel,
+			&session.Client,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession deletes every token in the given user's session with the given
+// ID. If the user has no such session, ErrRecordNotFound is returned.
+func (m TokenModel) DeleteSession(userID int64, sessionID string) error {
+	query := `delete from tokens where user_id = $1 and session_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// TouchSession records that the session with the given ID has just been used
+// from the given IP address and user agent, updating every token in it.
+func (m TokenModel) TouchSession(sessionID, ip, userAgent string) error {
+	query := `
+		update tokens
+		   set last_used_at = now(), ip = $2, user_agent = $3
+		 where session_id = $1
+	`
+
+	args := []any{sessionID, nullableString(ip), nullableString(userAgent)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
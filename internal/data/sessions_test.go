@@ -0,0 +1,114 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// findSession returns the session with the given ID.
+func findSession(t *testing.T, sessions []*Session, id string) *Session {
+	t.Helper()
+
+	for _, session := range sessions {
+		if session.ID == id {
+			return session
+		}
+	}
+
+	t.Fatalf("session %q is not in %+v", id, sessions)
+	return nil
+}
+
+func TestTokenModelSessions(t *testing.T) {
+	m := newTestModels(t)
+
+	alice := insertTestUser(t, m, "alice@example.com", "correct horse battery staple")
+	bob := insertTestUser(t, m, "bob@example.com", "correct horse battery staple")
+
+	// newSession signs the user in, as issueAuthTokens does.
+	newSession := func(user *User, meta SessionMetadata) *Token {
+		refresh, err := m.Tokens.NewInFamily(user.ID, time.Hour, ScopeRefresh, nil, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		access, err := m.Tokens.NewInFamily(user.ID, time.Minute, ScopeAuthentication, refresh, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return access
+	}
+
+	laptop := newSession(alice, SessionMetadata{UserAgent: "Firefox", IP: "192.0.2.1", DeviceLabel: "Laptop"})
+	phone := newSession(alice, SessionMetadata{UserAgent: "Safari", IP: "192.0.2.2"})
+	newSession(bob, SessionMetadata{UserAgent: "Chrome", IP: "192.0.2.3"})
+
+	if laptop.SessionID == "" || laptop.SessionID == phone.SessionID {
+		t.Fatalf("got session IDs %q and %q", laptop.SessionID, phone.SessionID)
+	}
+
+	sessions, err := m.Tokens.GetSessionsForUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions; want 2", len(sessions))
+	}
+
+	// The expiry of a session is that of its refresh token.
+	got := findSession(t, sessions, laptop.SessionID)
+	if got.UserAgent != "Firefox" || got.IP != "192.0.2.1" ||
+		got.DeviceLabel != "Laptop" || got.LastUsedAt != nil || got.Expiry.Before(time.Now().Add(50*time.Minute)) {
+		t.Errorf("got session %+v", got)
+	}
+
+	err = m.Tokens.TouchSession(laptop.SessionID, "198.51.100.1", "Firefox 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := m.Tokens.Get(ScopeAuthentication, laptop.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.LastUsedAt == nil {
+		t.Error("last use of the token was not recorded")
+	}
+
+	sessions, err = m.Tokens.GetSessionsForUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = findSession(t, sessions, laptop.SessionID)
+	if got.IP != "198.51.100.1" || got.UserAgent != "Firefox 2" || got.DeviceLabel != "Laptop" || got.LastUsedAt == nil {
+		t.Errorf("got session %+v after it was used", got)
+	}
+
+	// Users can only delete their own sessions.
+	err = m.Tokens.DeleteSession(bob.ID, laptop.SessionID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v deleting another user's session; want ErrRecordNotFound", err)
+	}
+
+	err = m.Tokens.DeleteSession(alice.ID, laptop.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Tokens.Get(ScopeAuthentication, laptop.Plaintext)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v for a token of a deleted session; want ErrRecordNotFound", err)
+	}
+
+	sessions, err = m.Tokens.GetSessionsForUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != phone.SessionID {
+		t.Errorf("got sessions %+v; want only the phone's", sessions)
+	}
+}
@@ -0,0 +1,164 @@
+package data
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms supported for tokens issued by this service, using their
+// JSON Web Algorithms (RFC 7518) names.
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported signing key")
+
+// SigningKey is an asymmetric private key used to sign tokens issued by this
+// service, identified by its key ID ("kid").
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	CreatedAt  time.Time
+}
+
+// newSigningKey wraps a private key in a SigningKey, choosing the algorithm
+// from the key type and deriving the key ID from the public key.
+func newSigningKey(privateKey crypto.Signer) (*SigningKey, error) {
+	key := &SigningKey{PrivateKey: privateKey}
+
+	switch privateKey.(type) {
+	case ed25519.PrivateKey:
+		key.Algorithm = AlgorithmEdDSA
+	case *rsa.PrivateKey:
+		key.Algorithm = AlgorithmRS256
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	key.ID = key.PublicJWK().Thumbprint()
+
+	return key, nil
+}
+
+// GenerateSigningKey creates a new random SigningKey for the given algorithm.
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("%w: algorithm %q", ErrUnsupportedKey, algorithm)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(privateKey)
+}
+
+// parseSigningKeyPKCS8 parses a DER encoded PKCS #8 RSA or Ed25519 private
+// key.
+func parseSigningKeyPKCS8(der []byte) (*SigningKey, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+
+	return newSigningKey(privateKey)
+}
+
+func (k *SigningKey) signingMethod() jwt.SigningMethod {
+	if k.Algorithm == AlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// Sign encodes the given claims as a JSON Web Token signed with the key. The
+// key ID is included in the token's header so that verifiers can select the
+// matching public key from the published key set.
+func (k *SigningKey) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signingMethod(), claims)
+	token.Header["kid"] = k.ID
+
+	return token.SignedString(k.PrivateKey)
+}
+
+// JWK is the public part of a signing key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKSet is a set of JSON Web Keys, as published at a JWKS endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWK returns the public part of the key as a JWK.
+func (k *SigningKey) PublicJWK() JWK {
+	jwk := JWK{Use: "sig", Algorithm: k.Algorithm, KeyID: k.ID}
+
+	switch public := k.PrivateKey.Public().(type) {
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	}
+
+	return jwk
+}
+
+// Thumbprint computes the RFC 7638 SHA-256 thumbprint of the key, which is
+// used as its key ID.
+func (j JWK) Thumbprint() string {
+	// RFC 7638 requires only the required members, in lexicographic order and
+	// without whitespace, which is what encoding/json produces for a map.
+	var members map[string]string
+
+	switch j.KeyType {
+	case "OKP":
+		members = map[string]string{"crv": j.Curve, "kty": j.KeyType, "x": j.X}
+	default:
+		members = map[string]string{"e": j.E, "kty": j.KeyType, "n": j.N}
+	}
+
+	js, _ := json.Marshal(members)
+	sum := sha256.Sum256(js)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
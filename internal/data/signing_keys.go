@@ -0,0 +1,442 @@
+package data
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultActiveSigningKeys is the number of active signing keys kept by
+// default: the key that signs new tokens and the one that will replace it.
+const DefaultActiveSigningKeys = 2
+
+// signingKeysLockID identifies the Postgres advisory lock held while signing
+// keys are replaced, so that instances of the service do not replace them at
+// the same time.
+const signingKeysLockID = 0x7369676e
+
+// SigningKeyManager owns the keys used to sign tokens issued by this service.
+// Keys are stored in the signing_keys table with their private key encrypted
+// under a master key, and are cached in memory. A manager created with
+// NewMemorySigningKeyManager keeps its keys only in memory, for use in tests.
+//
+// Several keys are active at once. The oldest active key signs new tokens,
+// while the newer ones are already published so that clients caching the key
+// set know them before they are used. Each rotation retires the signing key
+// and adds a new active key, so that the next oldest takes over. A retired
+// key continues to verify tokens for a grace period, so that tokens signed
+// shortly before the rotation remain valid until they expire.
+type SigningKeyManager struct {
+	DB               *sql.DB
+	Algorithm        string
+	RotationInterval time.Duration
+	GracePeriod      time.Duration
+	// ActiveKeys is the number of active keys, including the signing key.
+	ActiveKeys int
+
+	box *SecretBox
+
+	mu        sync.RWMutex
+	current   *SigningKey
+	newest    *SigningKey
+	verifying map[string]*SigningKey
+
+	// memory holds the keys of a manager without a database.
+	memoryMu sync.Mutex
+	memory   []*signingKeyRecord
+}
+
+// signingKeyRecord is a stored signing key. The zero time means that the key
+// has not been retired, or does not expire.
+type signingKeyRecord struct {
+	key       *SigningKey
+	retiredAt time.Time
+	expiresAt time.Time
+}
+
+// NewSigningKeyManager creates a SigningKeyManager that stores keys in db,
+// encrypting private keys with the given 32 byte AES-256 master key. Load must
+// be called before any keys are used.
+func NewSigningKeyManager(db *sql.DB, masterKey []byte, algorithm string, rotationInterval, gracePeriod time.Duration) (*SigningKeyManager, error) {
+	box, err := NewSecretBox(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := NewMemorySigningKeyManager(algorithm, rotationInterval, gracePeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	m.DB = db
+	m.box = box
+
+	return m, nil
+}
+
+// NewMemorySigningKeyManager creates a SigningKeyManager that only keeps keys
+// in memory, so that tests can sign tokens without a database. Its keys are
+// lost when it is discarded, so it must not be used to issue real tokens.
+// Load must be called before any keys are used.
+func NewMemorySigningKeyManager(algorithm string, rotationInterval, gracePeriod time.Duration) (*SigningKeyManager, error) {
+	if algorithm != AlgorithmEdDSA && algorithm != AlgorithmRS256 {
+		return nil, fmt.Errorf("%w: algorithm %q", ErrUnsupportedKey, algorithm)
+	}
+
+	m := &SigningKeyManager{
+		Algorithm:        algorithm,
+		RotationInterval: rotationInterval,
+		GracePeriod:      gracePeriod,
+		ActiveKeys:       DefaultActiveSigningKeys,
+		verifying:        map[string]*SigningKey{},
+	}
+
+	return m, nil
+}
+
+// Load reads all keys that have not expired into memory, generating new
+// active keys if there are fewer than ActiveKeys. If a stored key cannot be
+// decrypted, because it was encrypted under a different master key, an error
+// is returned rather than replacing the keys that other instances of the
+// service are using.
+func (m *SigningKeyManager) Load() error {
+	records, err := m.load()
+	if err != nil {
+		return err
+	}
+
+	active := 0
+	for _, r := range records {
+		if r.retiredAt.IsZero() {
+			active++
+		}
+	}
+
+	if active < m.ActiveKeys {
+		err = m.replace("", false)
+		if err != nil {
+			return err
+		}
+
+		records, err = m.load()
+		if err != nil {
+			return err
+		}
+	}
+
+	var current, newest *SigningKey
+	verifying := map[string]*SigningKey{}
+
+	for _, r := range records {
+		verifying[r.key.ID] = r.key
+		if r.retiredAt.IsZero() {
+			if current == nil {
+				current = r.key
+			}
+			newest = r.key
+		}
+	}
+
+	if current == nil {
+		return errors.New("no active signing key")
+	}
+
+	m.mu.Lock()
+	m.current = current
+	m.newest = newest
+	m.verifying = verifying
+	m.mu.Unlock()
+
+	return nil
+}
+
+// load returns the keys that have not expired, oldest first.
+func (m *SigningKeyManager) load() ([]*signingKeyRecord, error) {
+	if m.DB == nil {
+		m.memoryMu.Lock()
+		defer m.memoryMu.Unlock()
+
+		now := time.Now()
+		var records []*signingKeyRecord
+
+		for _, r := range m.memory {
+			if r.expiresAt.IsZero() || r.expiresAt.After(now) {
+				records = append(records, r)
+			}
+		}
+
+		m.memory = records
+		return records, nil
+	}
+
+	query := `
+		select kid, algorithm, private_key, created_at, retired_at
+		  from signing_keys
+		 where expires_at is null or expires_at > now()
+		 order by created_at, id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*signingKeyRecord
+
+	for rows.Next() {
+		var kid, algorithm string
+		var encrypted []byte
+		var createdAt time.Time
+		var retiredAt sql.NullTime
+
+		err := rows.Scan(&kid, &algorithm, &encrypted, &createdAt, &retiredAt)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := m.box.Decrypt(encrypted)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q cannot be decrypted with the master key: %w", kid, err)
+		}
+
+		key, err := parseSigningKeyPKCS8(der)
+		if err != nil {
+			return nil, err
+		}
+		key.CreatedAt = createdAt
+
+		records = append(records, &signingKeyRecord{key: key, retiredAt: retiredAt.Time})
+	}
+
+	return records, rows.Err()
+}
+
+// replace retires keys, then generates new active keys until there are
+// ActiveKeys of them. If emergency is set, every key is retired and expired
+// immediately. Otherwise the key with the given kid, if any, is retired and
+// expires after the grace period, unless it has already been retired, such as
+// by another instance of the service.
+func (m *SigningKeyManager) replace(kid string, emergency bool) error {
+	if m.DB == nil {
+		return m.replaceInMemory(kid, emergency)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "select pg_advisory_xact_lock($1)", signingKeysLockID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case emergency:
+		query := `
+			update signing_keys
+			   set retired_at = coalesce(retired_at, now()), expires_at = now()
+			 where expires_at is null or expires_at > now()
+		`
+		_, err = tx.ExecContext(ctx, query)
+	case kid != "":
+		query := `
+			update signing_keys
+			   set retired_at = now(),
+			       expires_at = now() + make_interval(secs => $2)
+			 where kid = $1
+			   and retired_at is null
+		`
+		_, err = tx.ExecContext(ctx, query, kid, m.GracePeriod.Seconds())
+	}
+	if err != nil {
+		return err
+	}
+
+	var active int
+	query := `select count(*) from signing_keys where retired_at is null`
+
+	err = tx.QueryRowContext(ctx, query).Scan(&active)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		insert into signing_keys (kid, algorithm, private_key)
+		values ($1, $2, $3)
+	`
+
+	for ; active < m.ActiveKeys; active++ {
+		key, err := GenerateSigningKey(m.Algorithm)
+		if err != nil {
+			return err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := m.box.Encrypt(der)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, query, key.ID, key.Algorithm, encrypted)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// replaceInMemory is replace for a manager without a database.
+func (m *SigningKeyManager) replaceInMemory(kid string, emergency bool) error {
+	m.memoryMu.Lock()
+	defer m.memoryMu.Unlock()
+
+	now := time.Now()
+	active := 0
+
+	for _, r := range m.memory {
+		switch {
+		case emergency:
+			if r.retiredAt.IsZero() {
+				r.retiredAt = now
+			}
+			r.expiresAt = now
+		case r.retiredAt.IsZero() && r.key.ID == kid:
+			r.retiredAt = now
+			r.expiresAt = now.Add(m.GracePeriod)
+		}
+
+		if r.retiredAt.IsZero() {
+			active++
+		}
+	}
+
+	for ; active < m.ActiveKeys; active++ {
+		key, err := GenerateSigningKey(m.Algorithm)
+		if err != nil {
+			return err
+		}
+		key.CreatedAt = now
+
+		m.memory = append(m.memory, &signingKeyRecord{key: key})
+	}
+
+	return nil
+}
+
+// Rotate retires the current signing key, so that the next active key takes
+// over, and adds a new active key. Previously issued tokens continue to verify
+// until the grace period has passed.
+func (m *SigningKeyManager) Rotate() (*SigningKey, error) {
+	err := m.replace(m.Current().ID, false)
+	if err == nil {
+		err = m.Load()
+	}
+
+	return m.Current(), err
+}
+
+// EmergencyRotate replaces every key with new ones and expires the old keys
+// immediately, so that all previously issued tokens stop verifying. It should
+// be used if a private key may have been compromised.
+func (m *SigningKeyManager) EmergencyRotate() (*SigningKey, error) {
+	err := m.replace("", true)
+	if err == nil {
+		err = m.Load()
+	}
+
+	return m.Current(), err
+}
+
+// RotateIfDue reloads the keys, picking up rotations made by other instances
+// of the service, and rotates the current key if the newest active key is
+// older than the rotation interval, so that each key signs tokens for one
+// interval after being published for the ones before. It reports whether a
+// rotation happened.
+func (m *SigningKeyManager) RotateIfDue() (bool, error) {
+	err := m.Load()
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.RLock()
+	newest := m.newest
+	m.mu.RUnlock()
+
+	if m.RotationInterval <= 0 || time.Since(newest.CreatedAt) < m.RotationInterval {
+		return false, nil
+	}
+
+	_, err = m.Rotate()
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Current returns the key used to sign new tokens.
+func (m *SigningKeyManager) Current() *SigningKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.current
+}
+
+// Get returns the key with the given key ID if it can still verify tokens.
+func (m *SigningKeyManager) Get(kid string) (*SigningKey, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.verifying[kid]
+	return key, ok
+}
+
+// JWKSet returns the public parts of every key that can verify tokens, for
+// publishing at the JWKS endpoint.
+func (m *SigningKeyManager) JWKSet() JWKSet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{m.current.PublicJWK()}}
+
+	for kid, key := range m.verifying {
+		if kid != m.current.ID {
+			set.Keys = append(set.Keys, key.PublicJWK())
+		}
+	}
+
+	return set
+}
+
+// keyFunc selects the verifying key named by a token's "kid" header, checking
+// that the token was signed with that key's algorithm.
+func (m *SigningKeyManager) keyFunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	key, ok := m.Get(kid)
+	if !ok || t.Method.Alg() != key.Algorithm {
+		return nil, ErrUnsupportedKey
+	}
+
+	return key.PrivateKey.Public(), nil
+}
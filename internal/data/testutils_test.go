@@ -0,0 +1,62 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/m5lapp/go-user-service/internal/testdb"
+)
+
+// newTestModels returns Models backed by a database of the test's own, or
+// skips the test if there is no test database. See testdb.New.
+func newTestModels(t *testing.T) Models {
+	t.Helper()
+
+	return NewModels(testdb.New(t, "../../migrations"))
+}
+
+// insertTestUser stores a new activated user with the given email address and
+// password.
+func insertTestUser(t *testing.T, m Models, email, password string) *User {
+	t.Helper()
+
+	user := &User{Email: email, Name: "Test User"}
+
+	err := user.Password.Set(password, DefaultArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.Activated = true
+
+	err = m.Users.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// insertTestService stores a new service with the given name and returns it
+// along with its secret.
+func insertTestService(t *testing.T, m Models, name string) (*Service, string) {
+	t.Helper()
+
+	service := &Service{Name: name, RedirectURIs: []string{"https://" + name + ".example.com/callback"}}
+
+	secret, err := service.GenerateSecret(DefaultArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Services.Insert(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return service, secret
+}
@@ -6,29 +6,75 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/m5lapp/go-service-toolkit/validator"
 )
 
 const (
-	ScopeActivation     = "activation"
-	ScopeAuthentication = "authentication"
+	ScopeActivation        = "activation"
+	ScopeAuthentication    = "authentication"
+	ScopeAuthorizationCode = "authorization-code"
+	ScopeMagicLink         = "magic-link"
+	ScopeMFAPending        = "mfa-pending"
+	ScopePasswordReset     = "password-reset"
+	ScopeRefresh           = "refresh"
 )
 
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// Token represents a token owned by either a user or a service. Exactly one of
+// UserID and ServiceID should be non-zero.
+//
+// Tokens issued through OAuth 2.0 also record the client (service) they were
+// issued to and the scope granted to it. Authorization codes additionally
+// record the redirect URI, PKCE code challenge and OpenID Connect nonce from
+// the authorization request so that they can be used when the code is
+// exchanged.
+//
+// Refresh tokens, and the access tokens issued with them, record the family
+// they belong to and, for rotated refresh tokens, the hash of their parent.
+// Tokens that represent a user's sign in also record the session they belong
+// to, along with its metadata.
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Plaintext     string     `json:"token"`
+	Hash          []byte     `json:"-"`
+	UserID        int64      `json:"-"`
+	ServiceID     int64      `json:"-"`
+	Expiry        time.Time  `json:"expiry"`
+	Scope         string     `json:"-"`
+	ClientID      int64      `json:"-"`
+	RedirectURI   string     `json:"-"`
+	CodeChallenge string     `json:"-"`
+	OAuthScope    string     `json:"-"`
+	Nonce         string     `json:"-"`
+	FamilyID      []byte     `json:"-"`
+	ParentHash    []byte     `json:"-"`
+	SessionID     string     `json:"-"`
+	CreatedAt     time.Time  `json:"-"`
+	LastUsedAt    *time.Time `json:"-"`
+	SessionMetadata
+}
+
+// AuthorizationRequest holds the details of an OAuth 2.0 authorization request
+// that are stored with the authorization code issued for it.
+type AuthorizationRequest struct {
+	RedirectURI   string
+	CodeChallenge string
+	OAuthScope    string
+	Nonce         string
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	now := time.Now()
+
 	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		UserID:    userID,
+		Expiry:    now.Add(ttl),
+		Scope:     scope,
+		CreatedAt: now,
 	}
 
 	randomBytes := make([]byte, 16)
@@ -68,13 +114,184 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewForService generates and stores a new token owned by the given service.
+func (m TokenModel) NewForService(serviceID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(0, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ServiceID = serviceID
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewForServiceClient generates and stores a new token owned by the given
+// service that has been issued to it as an OAuth 2.0 client with the given
+// OAuth scope, as in the client credentials grant.
+func (m TokenModel) NewForServiceClient(serviceID int64, ttl time.Duration, scope, oauthScope string) (*Token, error) {
+	token, err := generateToken(0, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ServiceID = serviceID
+	token.ClientID = serviceID
+	token.OAuthScope = oauthScope
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewForClient generates and stores a new token owned by the given user that
+// has been issued to the given OAuth 2.0 client with the given OAuth scope.
+// The token starts a new session described by meta.
+func (m TokenModel) NewForClient(userID, clientID int64, ttl time.Duration, scope, oauthScope string, meta SessionMetadata) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ClientID = clientID
+	token.OAuthScope = oauthScope
+	token.SessionMetadata = meta
+
+	token.SessionID, err = generateSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewAuthorizationCode generates and stores a new OAuth 2.0 authorization code
+// for the given user and client. The details of the authorization request are
+// stored with the code so that they can be verified when it is exchanged.
+func (m TokenModel) NewAuthorizationCode(userID, clientID int64, ttl time.Duration, req AuthorizationRequest) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthorizationCode)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ClientID = clientID
+	token.RedirectURI = req.RedirectURI
+	token.CodeChallenge = req.CodeChallenge
+	token.OAuthScope = req.OAuthScope
+	token.Nonce = req.Nonce
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewMagicLink generates and stores a single-use sign in token for the given
+// user that can only be redeemed by the given client with the verifier for
+// codeChallenge, which is sent to the user at the given redirect URI. The
+// session metadata of the request is kept so that it can be applied to the
+// session that is created when it is redeemed.
+func (m TokenModel) NewMagicLink(userID, clientID int64, ttl time.Duration, redirectURI, codeChallenge string, meta SessionMetadata) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeMagicLink)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ClientID = clientID
+	token.RedirectURI = redirectURI
+	token.CodeChallenge = codeChallenge
+	token.SessionMetadata = meta
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewMFAPending generates and stores a token showing that the given user has
+// provided their password but must still provide a second factor. The session
+// metadata is kept so that it can be applied to the session that is created
+// once they have.
+func (m TokenModel) NewMFAPending(userID int64, ttl time.Duration, meta SessionMetadata) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeMFAPending)
+	if err != nil {
+		return nil, err
+	}
+
+	token.SessionMetadata = meta
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewInFamily generates and stores a new token owned by the given user as part
+// of the refresh token family issued from parent. If parent is nil, a new
+// family and session are started, with the family identified by the hash of
+// the new token. The session metadata is updated from meta, except that an
+// empty device label leaves the existing label in place.
+func (m TokenModel) NewInFamily(userID int64, ttl time.Duration, scope string, parent *Token, meta SessionMetadata) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.SessionMetadata = meta
+
+	if parent == nil {
+		token.FamilyID = token.Hash
+
+		token.SessionID, err = generateSessionID()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		token.FamilyID = parent.FamilyID
+		if scope == ScopeRefresh {
+			token.ParentHash = parent.Hash
+		}
+
+		token.SessionID = parent.SessionID
+		token.CreatedAt = parent.CreatedAt
+		if token.DeviceLabel == "" {
+			token.DeviceLabel = parent.DeviceLabel
+		}
+	}
+
+	err = m.Insert(token)
+	return token, err
+}
+
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		insert into tokens (hash, user_id, expiry, scope)
-		values ($1, $2, $3, $4)
+		insert into tokens (
+			hash, user_id, service_id, expiry, scope, client_id, redirect_uri,
+			code_challenge, oauth_scope, nonce, family_id, parent_hash,
+			session_id, created_at, user_agent, ip, device_label
+		)
+		values (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
+			$16, $17
+		)
 	`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	// The single_owner constraint on the tokens table requires the unused
+	// owner column to be null rather than zero.
+	args := []any{
+		token.Hash,
+		nullableID(token.UserID),
+		nullableID(token.ServiceID),
+		token.Expiry,
+		token.Scope,
+		nullableID(token.ClientID),
+		nullableString(token.RedirectURI),
+		nullableString(token.CodeChallenge),
+		nullableString(token.OAuthScope),
+		nullableString(token.Nonce),
+		nullableBytes(token.FamilyID),
+		nullableBytes(token.ParentHash),
+		nullableString(token.SessionID),
+		token.CreatedAt,
+		nullableString(token.UserAgent),
+		nullableString(token.IP),
+		nullableString(token.DeviceLabel),
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -83,6 +300,63 @@ func (m TokenModel) Insert(token *Token) error {
 	return err
 }
 
+// DeleteByHash deletes the token with the given hash, whatever its scope.
+func (m TokenModel) DeleteByHash(hash []byte) error {
+	query := `delete from tokens where hash = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash)
+	return err
+}
+
+// DeleteFamily deletes every token in the refresh token family with the given
+// ID.
+func (m TokenModel) DeleteFamily(familyID []byte) error {
+	query := `delete from tokens where family_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, familyID)
+	return err
+}
+
+// DeleteAllForUserInScopes deletes all of the given user's tokens that have
+// any of the given scopes.
+func (m TokenModel) DeleteAllForUserInScopes(userID int64, scopes []string) error {
+	query := `delete from tokens where user_id = $1 and scope = any($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(scopes))
+	return err
+}
+
+// DeleteExpired deletes up to limit tokens whose expiry has passed and returns
+// the number deleted. Deleting in bounded batches avoids holding long locks
+// on the tokens table.
+func (m TokenModel) DeleteExpired(limit int) (int64, error) {
+	query := `
+		delete from tokens
+		 where hash in (
+		       select hash from tokens where expiry <= $1 limit $2
+		 )
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `delete from tokens where scope = $1 and user_id = $2`
 
@@ -92,3 +366,265 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// LatestExpiryForUser returns the latest expiry time of any of the given user's
+// tokens with the given scope. If the user has no such tokens, then the zero
+// time.Time is returned.
+func (m TokenModel) LatestExpiryForUser(scope string, userID int64) (time.Time, error) {
+	query := `select max(expiry) from tokens where scope = $1 and user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var expiry sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, query, scope, userID).Scan(&expiry)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return expiry.Time, nil
+}
+
+// Consume deletes the unexpired token with the given scope and plaintext and
+// returns it, so that a token can only ever be used once. The Plaintext field
+// of the returned Token is left empty. If no matching token exists,
+// ErrRecordNotFound is returned.
+func (m TokenModel) Consume(scope, tokenPlaintext string) (*Token, error) {
+	query := `
+		delete from tokens
+		 where hash = $1
+		   and scope = $2
+		   and expiry > $3
+	 returning hash, coalesce(user_id, 0), coalesce(service_id, 0), expiry,
+	           scope, coalesce(client_id, 0), coalesce(redirect_uri, ''),
+	           coalesce(code_challenge, ''), coalesce(oauth_scope, ''),
+	           coalesce(nonce, ''), coalesce(device_label, '')
+	`
+
+	var token Token
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	args := []any{tokenHash[:], scope, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.ServiceID,
+		&token.Expiry,
+		&token.Scope,
+		&token.ClientID,
+		&token.RedirectURI,
+		&token.CodeChallenge,
+		&token.OAuthScope,
+		&token.Nonce,
+		&token.DeviceLabel,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// Get retrieves the unexpired token with the given scope and plaintext. The
+// Plaintext field of the returned Token is left empty. If no matching token
+// exists, ErrRecordNotFound is returned.
+func (m TokenModel) Get(scope, tokenPlaintext string) (*Token, error) {
+	query := `
+		select hash, coalesce(user_id, 0), coalesce(service_id, 0), expiry,
+		       scope, coalesce(client_id, 0), coalesce(redirect_uri, ''),
+		       coalesce(code_challenge, ''), coalesce(oauth_scope, ''),
+		       coalesce(nonce, ''), family_id, coalesce(session_id, ''),
+		       last_used_at
+		  from tokens
+		 where hash = $1
+		   and scope = $2
+		   and expiry > $3
+	`
+
+	var token Token
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	args := []any{tokenHash[:], scope, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.ServiceID,
+		&token.Expiry,
+		&token.Scope,
+		&token.ClientID,
+		&token.RedirectURI,
+		&token.CodeChallenge,
+		&token.OAuthScope,
+		&token.Nonce,
+		&token.FamilyID,
+		&token.SessionID,
+		&token.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// UseRefreshToken marks the unexpired refresh token with the given plaintext as
+// used and returns it. A refresh token can only be used once; if it has
+// already been used, every token in its family is deleted and
+// ErrRefreshTokenReused is returned, since either the legitimate client or an
+// attacker is holding a stolen token. If no matching token exists,
+// ErrRecordNotFound is returned.
+func (m TokenModel) UseRefreshToken(tokenPlaintext string) (*Token, error) {
+	query := `
+		select hash, user_id, expiry, scope, family_id, used_at is not null,
+		       coalesce(session_id, ''), created_at, coalesce(device_label, '')
+		  from tokens
+		 where hash = $1
+		   and scope = $2
+		   and expiry > $3
+		   for update
+	`
+
+	var token Token
+	var used bool
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	args := []any{tokenHash[:], ScopeRefresh, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.FamilyID,
+		&used,
+		&token.SessionID,
+		&token.CreatedAt,
+		&token.DeviceLabel,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if used {
+		_, err = tx.ExecContext(ctx, `delete from tokens where family_id = $1`, token.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ErrRefreshTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `update tokens set used_at = now() where hash = $1`, token.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// TokenIntrospection describes an active token as reported by an RFC 7662
+// introspection response. Subject is the owning user's UserID, or the owning
+// service's name, and Client is the name of the OAuth 2.0 client (or owning
+// service) that it was issued to, if any.
+type TokenIntrospection struct {
+	Scope      string
+	OAuthScope string
+	Subject    string
+	Client     string
+	Expiry     time.Time
+	CreatedAt  time.Time
+}
+
+// Introspect retrieves the details of the access or refresh token with the
+// given plaintext. If the token does not exist, has another scope, has expired
+// or been used, or its owner or the client that it was issued to has been
+// suspended or deleted, ErrRecordNotFound is returned.
+func (m TokenModel) Introspect(tokenPlaintext string) (*TokenIntrospection, error) {
+	query := `
+		select tokens.scope, coalesce(tokens.oauth_scope, ''),
+		       coalesce(users.user_id, owners.name),
+		       coalesce(clients.name, owners.name, ''), tokens.expiry,
+		       tokens.created_at
+		  from tokens
+	 left join users
+	        on users.id = tokens.user_id
+	 left join services owners
+	        on owners.id = tokens.service_id
+	 left join services clients
+	        on clients.id = tokens.client_id
+		 where tokens.hash = $1
+		   and tokens.scope = any($2)
+		   and tokens.expiry > $3
+		   and tokens.used_at is null
+		   and (users.id is null or (users.suspended = false and users.deleted = false))
+		   and (owners.id is null or (owners.suspended = false and owners.deleted = false))
+		   and (clients.id is null or (clients.suspended = false and clients.deleted = false))
+	`
+
+	var info TokenIntrospection
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	scopes := pq.Array([]string{ScopeAuthentication, ScopeRefresh})
+	args := []any{tokenHash[:], scopes, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&info.Scope,
+		&info.OAuthScope,
+		&info.Subject,
+		&info.Client,
+		&info.Expiry,
+		&info.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &info, nil
+}
@@ -0,0 +1,157 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenModelIntrospect(t *testing.T) {
+	m := newTestModels(t)
+
+	user := insertTestUser(t, m, "alice@example.com", "correct horse battery staple")
+	client, _ := insertTestService(t, m, "photo-app")
+	meta := SessionMetadata{IP: "192.0.2.1", UserAgent: "test"}
+
+	access, err := m.Tokens.NewForClient(user.ID, client.ID, time.Hour, ScopeAuthentication, "openid users:read", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh, err := m.Tokens.NewInFamily(user.ID, time.Hour, ScopeRefresh, nil, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := m.Tokens.Introspect(access.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Scope != ScopeAuthentication || info.OAuthScope != "openid users:read" ||
+		info.Subject != user.UserID || info.Client != client.Name {
+		t.Errorf("got %+v", info)
+	}
+
+	info, err = m.Tokens.Introspect(refresh.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Scope != ScopeRefresh || info.Subject != user.UserID || info.Client != "" {
+		t.Errorf("got %+v", info)
+	}
+
+	// Tokens that are not access or refresh tokens are never active, so that
+	// they cannot be passed off as a signed in session.
+	mfaPending, err := m.Tokens.NewMFAPending(user.ID, time.Hour, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := m.Tokens.NewAuthorizationCode(user.ID, client.ID, time.Hour, AuthorizationRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	others := []*Token{mfaPending, code}
+	for _, scope := range []string{ScopeActivation, ScopePasswordReset, ScopeMagicLink} {
+		token, err := m.Tokens.New(user.ID, time.Hour, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		others = append(others, token)
+	}
+
+	for _, token := range others {
+		_, err := m.Tokens.Introspect(token.Plaintext)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("%s token: got %v; want ErrRecordNotFound", token.Scope, err)
+		}
+	}
+
+	_, err = m.Tokens.Introspect("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("unknown token: got %v; want ErrRecordNotFound", err)
+	}
+}
+
+func TestTokenModelIntrospectInactiveClient(t *testing.T) {
+	for _, column := range []string{"suspended", "deleted"} {
+		t.Run(column, func(t *testing.T) {
+			m := newTestModels(t)
+
+			user := insertTestUser(t, m, "alice@example.com", "correct horse battery staple")
+			client, _ := insertTestService(t, m, "photo-app")
+
+			token, err := m.Tokens.NewForClient(user.ID, client.ID, time.Hour, ScopeAuthentication,
+				"openid", SessionMetadata{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = m.Tokens.DB.Exec(`update services set `+column+` = true where id = $1`, client.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = m.Tokens.Introspect(token.Plaintext)
+			if !errors.Is(err, ErrRecordNotFound) {
+				t.Errorf("got %v; want ErrRecordNotFound", err)
+			}
+		})
+	}
+}
+
+func TestTokenModelIntrospectInactiveUser(t *testing.T) {
+	m := newTestModels(t)
+
+	user := insertTestUser(t, m, "alice@example.com", "correct horse battery staple")
+
+	token, err := m.Tokens.New(user.ID, time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.Suspended = true
+
+	err = m.Users.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Tokens.Introspect(token.Plaintext)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v; want ErrRecordNotFound", err)
+	}
+}
+
+func TestTokenModelDeleteExpired(t *testing.T) {
+	m := newTestModels(t)
+
+	user := insertTestUser(t, m, "alice@example.com", "correct horse battery staple")
+
+	for i := 0; i < 3; i++ {
+		_, err := m.Tokens.New(user.ID, -time.Minute, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	live, err := m.Tokens.New(user.ID, time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired tokens are deleted in batches of at most the given size.
+	for _, want := range []int64{2, 1, 0} {
+		deleted, err := m.Tokens.DeleteExpired(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != want {
+			t.Errorf("got %d tokens deleted; want %d", deleted, want)
+		}
+	}
+
+	_, err = m.Tokens.Get(ScopeAuthentication, live.Plaintext)
+	if err != nil {
+		t.Errorf("got %v for a token that has not expired", err)
+	}
+}
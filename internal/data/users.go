@@ -35,6 +35,7 @@ type User struct {
 	TimeZone     *string         `json:"time_zone,omitempty"`
 	Activated    bool            `json:"-"`
 	Suspended    bool            `json:"-"`
+	LoginFailures
 }
 
 // IsAnonymous compares the User receiver to the AnonymousUser struct.
@@ -42,13 +43,21 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// CanSignIn reports whether the user may be issued authentication tokens.
+// Suspended users may not, and nor may users who have not yet activated their
+// account.
+func (u *User) CanSignIn() bool {
+	return u.Activated && !u.Suspended
+}
+
 // ValidateUser checks if a user is considered valid and stores any errors in
-// the provided validator.Validator struct.
-func ValidateUser(v *validator.Validator, user *User) {
+// the provided validator.Validator struct. A new plaintext password must
+// satisfy the given policy.
+func ValidateUser(v *validator.Validator, user *User, policy PasswordPolicy) {
 	validator.ValidateEmail(v, user.Email)
 
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		policy.Validate(v, *user.Password.plaintext, user)
 	}
 
 	if user.Password.hash == nil {
@@ -138,7 +147,7 @@ func (m UserModel) Insert(user *User) error {
 
 // GetByIdentifier queries the database for a user based on the given field for
 // the given value. If no matching record exists, ErrRecordNotFound is returned.
-// Valid field names are "email" and "user_id".
+// Valid field names are "id", "email" and "user_id".
 func (m UserModel) GetByIdentifier(field, value string) (*User, error) {
 	query := `
 		select
@@ -146,7 +155,8 @@ func (m UserModel) GetByIdentifier(field, value string) (*User, error) {
 			users.user_id, users.email, users.password_hash, users.name,
 			users.friendly_name, users.birth_date, users.gender,
 			users.country_code, users.time_zone, users.activated,
-			users.suspended
+			users.suspended, users.failed_login_count,
+			users.last_failed_login_at, users.locked_until
 		  from users
 		 where %s = $1
 		   and deleted = false
@@ -154,8 +164,8 @@ func (m UserModel) GetByIdentifier(field, value string) (*User, error) {
 
 	var user User
 
-	if field != "email" && field != "user_id" {
-		return nil, errors.New("lookup field must be one of email, user_id")
+	if field != "id" && field != "email" && field != "user_id" {
+		return nil, errors.New("lookup field must be one of id, email, user_id")
 	}
 	q := fmt.Sprintf(query, field)
 
@@ -178,6 +188,9 @@ func (m UserModel) GetByIdentifier(field, value string) (*User, error) {
 		&user.TimeZone,
 		&user.Activated,
 		&user.Suspended,
+		&user.LoginFailures.Count,
+		&user.LoginFailures.LastFailedAt,
+		&user.LoginFailures.LockedUntil,
 	)
 
 	if err != nil {
@@ -249,7 +262,8 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 			   users.user_id, users.email, users.password_hash, users.name,
 			   users.friendly_name, users.birth_date, users.gender,
 			   users.country_code, users.time_zone, users.activated,
-			   users.suspended
+			   users.suspended, users.failed_login_count,
+			   users.last_failed_login_at, users.locked_until
 		  from users
 	inner join tokens
 	        on users.id = tokens.user_id
@@ -284,6 +298,9 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.TimeZone,
 		&user.Activated,
 		&user.Suspended,
+		&user.LoginFailures.Count,
+		&user.LoginFailures.LastFailedAt,
+		&user.LoginFailures.LockedUntil,
 	)
 	if err != nil {
 		switch {
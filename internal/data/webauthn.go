@@ -0,0 +1,375 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lib/pq"
+	"github.com/m5lapp/go-service-toolkit/validator"
+)
+
+const (
+	CeremonyWebAuthnLogin        = "login"
+	CeremonyWebAuthnRegistration = "registration"
+)
+
+var ErrDuplicateCredential = errors.New("duplicate webauthn credential")
+
+// WebAuthnCredential is a public key credential that a user has registered
+// with an authenticator, such as a passkey or security key.
+type WebAuthnCredential struct {
+	ID           int64               `json:"id"`
+	UserID       int64               `json:"-"`
+	Name         string              `json:"name"`
+	CreatedAt    time.Time           `json:"created_at"`
+	LastUsedAt   *time.Time          `json:"last_used_at"`
+	CloneWarning bool                `json:"clone_warning"`
+	Credential   webauthn.Credential `json:"-"`
+}
+
+func ValidateCredentialName(v *validator.Validator, name string) {
+	v.Check(len(name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+// WebAuthnUser adapts a User and their registered credentials to the
+// webauthn.User interface. The user's public user_id is used as the WebAuthn
+// user handle, so that it can be used to find them when signing in with a
+// discoverable credential.
+type WebAuthnUser struct {
+	*User
+	Credentials []*WebAuthnCredential
+}
+
+// Account returns the underlying User, or nil if u is nil.
+func (u *WebAuthnUser) Account() *User {
+	if u == nil {
+		return nil
+	}
+	return u.User
+}
+
+func (u *WebAuthnUser) WebAuthnID() []byte {
+	return []byte(u.UserID)
+}
+
+func (u *WebAuthnUser) WebAuthnName() string {
+	return u.Email
+}
+
+func (u *WebAuthnUser) WebAuthnDisplayName() string {
+	return u.Name
+}
+
+func (u *WebAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.Credentials))
+
+	for i, c := range u.Credentials {
+		credentials[i] = c.Credential
+	}
+
+	return credentials
+}
+
+// CredentialDescriptors returns descriptors of the user's credentials, used to
+// exclude them from registration or to list them when signing in.
+func (u *WebAuthnUser) CredentialDescriptors() []protocol.CredentialDescriptor {
+	descriptors := make([]protocol.CredentialDescriptor, len(u.Credentials))
+
+	for i, c := range u.Credentials {
+		descriptors[i] = c.Credential.Descriptor()
+	}
+
+	return descriptors
+}
+
+// Credential returns the user's credential with the given credential ID, or
+// nil if they have none.
+func (u *WebAuthnUser) Credential(credentialID []byte) *WebAuthnCredential {
+	for _, c := range u.Credentials {
+		if string(c.Credential.ID) == string(credentialID) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+type WebAuthnModel struct {
+	DB *sql.DB
+}
+
+// Insert stores a newly registered credential. If the credential ID is
+// already registered, ErrDuplicateCredential is returned.
+func (m WebAuthnModel) Insert(credential *WebAuthnCredential) error {
+	query := `
+		insert into webauthn_credentials (user_id, credential_id, public_key,
+		            attestation_type, transports, aaguid, sign_count,
+		            backup_eligible, backup_state, name)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		returning id, created_at
+	`
+
+	c := credential.Credential
+
+	transports := make([]string, len(c.Transport))
+	for i, t := range c.Transport {
+		transports[i] = string(t)
+	}
+
+	args := []any{
+		credential.UserID,
+		c.ID,
+		c.PublicKey,
+		c.AttestationType,
+		pq.Array(transports),
+		nullableBytes(c.Authenticator.AAGUID),
+		int64(c.Authenticator.SignCount),
+		c.Flags.BackupEligible,
+		c.Flags.BackupState,
+		credential.Name,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credential.ID, &credential.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "webauthn_credentials_credential_id_key"`:
+			return ErrDuplicateCredential
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForUser returns the given user's credentials, oldest first.
+func (m WebAuthnModel) GetAllForUser(userID int64) ([]*WebAuthnCredential, error) {
+	query := `
+		select id, user_id, name, created_at, last_used_at, clone_warning,
+		       credential_id, public_key, attestation_type, transports,
+		       coalesce(aaguid, ''), sign_count, backup_eligible, backup_state
+		  from webauthn_credentials
+		 where user_id = $1
+	  order by created_at, id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []*WebAuthnCredential{}
+
+	for rows.Next() {
+		var credential WebAuthnCredential
+		var transports []string
+		var signCount int64
+
+		c := &credential.Credential
+
+		err := rows.Scan(
+			&credential.ID,
+			&credential.UserID,
+			&credential.Name,
+			&credential.CreatedAt,
+			&credential.LastUsedAt,
+			&credential.CloneWarning,
+			&c.ID,
+			&c.PublicKey,
+			&c.AttestationType,
+			pq.Array(&transports),
+			&c.Authenticator.AAGUID,
+			&signCount,
+			&c.Flags.BackupEligible,
+			&c.Flags.BackupState,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range transports {
+			c.Transport = append(c.Transport, protocol.AuthenticatorTransport(t))
+		}
+		c.Authenticator.SignCount = uint32(signCount)
+		c.Authenticator.CloneWarning = credential.CloneWarning
+
+		credentials = append(credentials, &credential)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// RecordLogin stores the state of a credential after it has been used to sign
+// in. The signature counter must have increased since it was last stored, or
+// be zero both times for authenticators that do not implement one. Otherwise
+// the counter is left unchanged and the credential is flagged as possibly
+// cloned. The check is made against the stored value so that concurrent sign
+// ins with the same counter are also caught.
+func (m WebAuthnModel) RecordLogin(credential *WebAuthnCredential) error {
+	query := `
+		update webauthn_credentials
+		   set clone_warning = clone_warning
+		           or not (sign_count < $2 or (sign_count = 0 and $2 = 0)),
+		       sign_count = case
+		           when sign_count < $2 then $2 else sign_count
+		       end,
+		       backup_state = $3,
+		       last_used_at = now()
+		 where id = $1
+	 returning clone_warning
+	`
+
+	c := credential.Credential
+	args := []any{credential.ID, int64(c.Authenticator.SignCount), c.Flags.BackupState}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credential.CloneWarning)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete deletes the given user's credential with the given ID. If the user
+// has no such credential, ErrRecordNotFound is returned.
+func (m WebAuthnModel) Delete(userID, id int64) error {
+	query := `delete from webauthn_credentials where user_id = $1 and id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// NewCeremony stores the state of a ceremony that has just been started and
+// returns a token that the client must present to finish it. userID is zero
+// for a sign in where the user is not yet known.
+func (m WebAuthnModel) NewCeremony(userID int64, ttl time.Duration, ceremony string, session *webauthn.SessionData) (*Token, error) {
+	token, err := generateToken(userID, ttl, ceremony)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		insert into webauthn_ceremonies (hash, user_id, ceremony, session, expiry)
+		values ($1, $2, $3, $4, $5)
+	`
+
+	args := []any{token.Hash, nullableID(userID), ceremony, js, token.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return token, err
+}
+
+// ConsumeCeremony deletes the unexpired ceremony of the given type with the
+// given token plaintext and returns the ID of the user that started it, which
+// may be zero, and its state. A ceremony can therefore only be finished once,
+// successfully or not. If no matching ceremony exists, ErrRecordNotFound is
+// returned.
+func (m WebAuthnModel) ConsumeCeremony(ceremony, tokenPlaintext string) (int64, *webauthn.SessionData, error) {
+	query := `
+		delete from webauthn_ceremonies
+		 where hash = $1
+		   and ceremony = $2
+		   and expiry > $3
+	 returning coalesce(user_id, 0), session
+	`
+
+	var userID int64
+	var js []byte
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	args := []any{tokenHash[:], ceremony, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&userID, &js)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, nil, ErrRecordNotFound
+		default:
+			return 0, nil, err
+		}
+	}
+
+	var session webauthn.SessionData
+	err = json.Unmarshal(js, &session)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return userID, &session, nil
+}
+
+// DeleteExpiredCeremonies deletes up to limit ceremonies whose expiry has
+// passed and returns the number deleted.
+func (m WebAuthnModel) DeleteExpiredCeremonies(limit int) (int64, error) {
+	query := `
+		delete from webauthn_ceremonies
+		 where hash in (
+		       select hash from webauthn_ceremonies where expiry <= $1 limit $2
+		 )
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type memoryBucket struct {
+	limiter   *rate.Limiter
+	expiresAt time.Time
+}
+
+// MemoryStore keeps token buckets in memory, so limits only apply to requests
+// handled by the same process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryStore) Allow(key string, limit Limit) (Result, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{limiter: rate.NewLimiter(rate.Limit(limit.rate()), limit.Requests)}
+		s.buckets[key] = b
+	}
+
+	allowed := b.limiter.AllowN(now, 1)
+	b.expiresAt = now.Add(limit.Period)
+
+	return newResult(allowed, b.limiter.TokensAt(now), limit), nil
+}
+
+func (s *MemoryStore) DeleteExpired(limit int) (int64, error) {
+	now := time.Now()
+	var deleted int64
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, b := range s.buckets {
+		if deleted >= int64(limit) {
+			break
+		}
+
+		if !b.expiresAt.After(now) {
+			delete(s.buckets, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
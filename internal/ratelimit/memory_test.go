@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreAllow(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Requests: 3, Period: time.Hour}
+
+	for i := 0; i < limit.Requests; i++ {
+		result, err := s.Allow("login:ip:192.0.2.1", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != limit.Requests-i-1 {
+			t.Fatalf("request %d: got %+v", i+1, result)
+		}
+	}
+
+	result, err := s.Allow("login:ip:192.0.2.1", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > 20*time.Minute {
+		t.Errorf("got %+v; want denied with a retry after of up to 20m", result)
+	}
+
+	// Other keys have buckets of their own.
+	result, err = s.Allow("login:ip:192.0.2.2", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Error("request with another key was denied")
+	}
+}
+
+func TestMemoryStoreDeleteExpired(t *testing.T) {
+	s := NewMemoryStore()
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := s.Allow(key, Limit{Requests: 1, Period: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := s.Allow("d", Limit{Requests: 1, Period: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	deleted, err := s.DeleteExpired(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("got %d deleted; want 2", deleted)
+	}
+
+	deleted, err = s.DeleteExpired(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("got %d deleted; want 1", deleted)
+	}
+
+	if _, ok := s.buckets["d"]; !ok || len(s.buckets) != 1 {
+		t.Errorf("got %d buckets; want only the one that has not refilled", len(s.buckets))
+	}
+}
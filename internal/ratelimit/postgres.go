@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresStore keeps token buckets in the rate_limits table, so that limits
+// apply across every replica using the same database.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func (s PostgresStore) Allow(key string, limit Limit) (Result, error) {
+	// The bucket is refilled for the time since it was last updated and a
+	// token is taken in a single statement, so concurrent requests cannot both
+	// take the last token. If there is no token to take, the row is left
+	// unchanged and nothing is returned.
+	query := `
+		insert into rate_limits as l (key, tokens, updated_at, expires_at)
+		values ($1, $2::double precision - 1, $3, $4)
+		    on conflict (key) do update
+		   set tokens = least($2::double precision,
+		                      l.tokens + extract(epoch from $3::timestamptz - l.updated_at) * $5::double precision) - 1,
+		       updated_at = $3,
+		       expires_at = $4
+		 where least($2::double precision,
+		             l.tokens + extract(epoch from $3::timestamptz - l.updated_at) * $5::double precision) >= 1
+	 returning tokens
+	`
+
+	now := time.Now()
+	args := []any{key, float64(limit.Requests), now, now.Add(limit.Period), limit.rate()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tokens float64
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&tokens)
+	if err == nil {
+		return newResult(true, tokens, limit), nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Result{}, err
+	}
+
+	query = `
+		select least($2::double precision,
+		             tokens + extract(epoch from $3::timestamptz - updated_at) * $4::double precision)
+		  from rate_limits
+		 where key = $1
+	`
+
+	err = s.DB.QueryRowContext(ctx, query, key, float64(limit.Requests), now, limit.rate()).Scan(&tokens)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return newResult(false, tokens, limit), nil
+}
+
+func (s PostgresStore) DeleteExpired(limit int) (int64, error) {
+	query := `
+		delete from rate_limits
+		 where key in (
+		       select key from rate_limits where expires_at <= $1 limit $2
+		 )
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,76 @@
+// Package ratelimit limits how often requests sharing a key can be made using
+// token buckets, which can be kept in memory for a single replica or in
+// PostgreSQL to be shared between replicas.
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit allows up to Requests requests in a burst, refilling at a steady rate
+// so that Requests more are allowed every Period.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// rate returns the number of requests allowed per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// Result describes the state of a key's bucket after a request.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// newResult describes a bucket holding the given number of tokens.
+func newResult(allowed bool, tokens float64, limit Limit) Result {
+	tokens = math.Max(tokens, 0)
+	rate := limit.rate()
+
+	result := Result{
+		Allowed:   allowed,
+		Limit:     limit.Requests,
+		Remaining: int(tokens),
+		Reset:     seconds((float64(limit.Requests) - tokens) / rate),
+	}
+
+	if !allowed {
+		result.RetryAfter = seconds((1 - tokens) / rate)
+	}
+
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Tighter reports whether r is closer to its limit than other, so that it is
+// the one that should be reported when a request is subject to both.
+func (r Result) Tighter(other Result) bool {
+	switch {
+	case r.Allowed != other.Allowed:
+		return !r.Allowed
+	case r.Remaining != other.Remaining:
+		return r.Remaining < other.Remaining
+	default:
+		return r.Reset > other.Reset
+	}
+}
+
+// Store keeps a token bucket for each key.
+type Store interface {
+	// Allow takes a token from the key's bucket, creating a full one if
+	// necessary, and reports whether there was one to take.
+	Allow(key string, limit Limit) (Result, error)
+	// DeleteExpired deletes up to limit buckets that have refilled completely
+	// and returns the number deleted.
+	DeleteExpired(limit int) (int64, error)
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewResult(t *testing.T) {
+	limit := Limit{Requests: 10, Period: 10 * time.Second}
+
+	result := newResult(true, 4.5, limit)
+	if !result.Allowed || result.Limit != 10 || result.Remaining != 4 || result.RetryAfter != 0 {
+		t.Errorf("got %+v", result)
+	}
+	if result.Reset != 5500*time.Millisecond {
+		t.Errorf("got reset %s; want 5.5s", result.Reset)
+	}
+
+	result = newResult(false, 0.25, limit)
+	if result.Allowed || result.Remaining != 0 || result.RetryAfter != 750*time.Millisecond {
+		t.Errorf("got %+v", result)
+	}
+
+	// A bucket in debt is reported as empty.
+	result = newResult(false, -2, limit)
+	if result.Remaining != 0 || result.Reset != 10*time.Second || result.RetryAfter != time.Second {
+		t.Errorf("got %+v", result)
+	}
+}
+
+func TestResultTighter(t *testing.T) {
+	tests := []struct {
+		name  string
+		r     Result
+		other Result
+		want  bool
+	}{
+		{"Denied", Result{Allowed: false, Remaining: 5}, Result{Allowed: true, Remaining: 0}, true},
+		{"Allowed", Result{Allowed: true, Remaining: 0}, Result{Allowed: false, Remaining: 5}, false},
+		{"Fewer remaining", Result{Allowed: true, Remaining: 1}, Result{Allowed: true, Remaining: 2}, true},
+		{"More remaining", Result{Allowed: true, Remaining: 2}, Result{Allowed: true, Remaining: 1}, false},
+		{"Later reset", Result{Allowed: true, Remaining: 1, Reset: time.Minute}, Result{Allowed: true, Remaining: 1, Reset: time.Second}, true},
+		{"Same", Result{Allowed: true, Remaining: 1, Reset: time.Minute}, Result{Allowed: true, Remaining: 1, Reset: time.Minute}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.r.Tighter(tt.other)
+			if got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Package testdb provides PostgreSQL databases for tests that need one.
+package testdb
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// DSNVariable is the environment variable holding the DSN of the database
+// that tests are run against. It must have the citext extension installed.
+const DSNVariable = "USER_SERVICE_TEST_DB_DSN"
+
+// New creates a schema of its own for the test in the database given by
+// DSNVariable, applies the migrations in migrationsDir to it, and returns a
+// connection pool using it. The schema is dropped when the test finishes. The
+// test is skipped if DSNVariable is not set.
+func New(t testing.TB, migrationsDir string) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv(DSNVariable)
+	if dsn == "" {
+		t.Skipf("%s is not set", DSNVariable)
+	}
+
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = admin.Exec("create schema " + schema)
+	if err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		defer admin.Close()
+
+		_, err := admin.Exec("drop schema " + schema + " cascade")
+		if err != nil {
+			t.Errorf("dropping test schema: %s", err)
+		}
+	})
+
+	// The public schema is kept on the search path for the citext extension.
+	db, err := sql.Open("postgres", withSearchPath(dsn, schema+",public"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrations, err := filepath.Glob(filepath.Join(migrationsDir, "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatalf("no migrations found in %s", migrationsDir)
+	}
+	sort.Strings(migrations)
+
+	for _, migration := range migrations {
+		script, err := os.ReadFile(migration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.Exec(string(script))
+		if err != nil {
+			t.Fatalf("applying %s: %s", filepath.Base(migration), err)
+		}
+	}
+
+	return db
+}
+
+// withSearchPath adds a search_path run-time parameter to a URL or key/value
+// DSN.
+func withSearchPath(dsn, searchPath string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			q := u.Query()
+			q.Set("search_path", searchPath)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+
+	return dsn + " search_path=" + searchPath
+}
@@ -0,0 +1,6 @@
+delete from permissions
+ using services
+ where permissions.service_id = services.id
+   and services.name = 'user-service';
+
+delete from services where name = 'user-service';
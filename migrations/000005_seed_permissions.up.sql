@@ -0,0 +1,23 @@
+-- Register the user service itself so that it can own its permissions. It is
+-- given an empty password hash as it never needs to authenticate against
+-- itself.
+insert into services (name, description, password_hash)
+values ('user-service', 'Authentication and authorisation of users', '')
+on conflict (name) do nothing;
+
+insert into permissions (service_id, permission)
+select services.id, codes.permission
+  from services
+ cross join (values
+    ('users:read'),
+    ('users:write'),
+    ('permissions:write'),
+    ('tokens:authenticate'),
+    ('tokens:create')
+ ) as codes (permission)
+ where services.name = 'user-service'
+   and not exists (
+       select 1 from permissions
+        where permissions.service_id = services.id
+          and permissions.permission = codes.permission
+   );
@@ -0,0 +1,20 @@
+create table if not exists roles (
+    id          bigserial primary key,
+    version     integer not null default 1,
+    created_at  timestamp(8) with time zone not null default now(),
+    updated_at  timestamp(8) with time zone not null default now(),
+    name        citext unique not null,
+    description text
+);
+
+create table if not exists role_permissions (
+    role_id       bigint not null references roles(id) on delete cascade,
+    permission_id bigint not null references permissions(id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles (
+    user_id bigint not null references users(id) on delete cascade,
+    role_id bigint not null references roles(id) on delete cascade,
+    primary key (user_id, role_id)
+);
@@ -0,0 +1,9 @@
+insert into permissions (service_id, permission)
+select services.id, 'services:write'
+  from services
+ where services.name = 'user-service'
+   and not exists (
+       select 1 from permissions
+        where permissions.service_id = services.id
+          and permissions.permission = 'services:write'
+   );
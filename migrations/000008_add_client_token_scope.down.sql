@@ -0,0 +1,2 @@
+alter table tokens drop column if exists oauth_scope;
+alter table tokens drop column if exists client_id;
@@ -0,0 +1,4 @@
+-- The OAuth 2.0 client that a token was issued to, and the scope granted to
+-- it.
+alter table tokens add column if not exists client_id   bigint references services(id) on delete cascade;
+alter table tokens add column if not exists oauth_scope text;
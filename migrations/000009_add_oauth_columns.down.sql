@@ -0,0 +1,4 @@
+alter table tokens drop column if exists code_challenge;
+alter table tokens drop column if exists redirect_uri;
+
+alter table services drop column if exists redirect_uris;
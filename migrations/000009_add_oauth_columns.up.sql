@@ -0,0 +1,6 @@
+alter table services add column if not exists redirect_uris text[] not null default '{}';
+
+-- The details of the authorization request that an authorization code was
+-- issued for.
+alter table tokens add column if not exists redirect_uri   text;
+alter table tokens add column if not exists code_challenge text;
@@ -0,0 +1 @@
+alter table services drop column if exists public;
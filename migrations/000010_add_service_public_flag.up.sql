@@ -0,0 +1,4 @@
+-- Public OAuth 2.0 clients, such as mobile and single page apps, cannot keep a
+-- secret, so they identify themselves with their client_id alone. Every other
+-- client must authenticate with its secret.
+alter table services add column if not exists public bool not null default false;
@@ -0,0 +1,3 @@
+-- The OpenID Connect nonce from the authorization request that an
+-- authorization code was issued for.
+alter table tokens add column if not exists nonce text;
@@ -0,0 +1,12 @@
+-- Keys used to sign JWTs issued by this service. The private key is a PKCS #8
+-- DER encoded key encrypted with the master key. A key stops being used to
+-- sign tokens once it is retired, and stops verifying them once it expires.
+create table if not exists signing_keys (
+    id          bigserial primary key,
+    created_at  timestamp(0) with time zone not null default now(),
+    kid         text unique not null,
+    algorithm   text not null,
+    private_key bytea not null,
+    retired_at  timestamp(0) with time zone,
+    expires_at  timestamp(0) with time zone
+);
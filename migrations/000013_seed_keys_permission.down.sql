@@ -0,0 +1,5 @@
+delete from permissions
+ using services
+ where permissions.service_id = services.id
+   and services.name = 'user-service'
+   and permissions.permission = 'keys:write';
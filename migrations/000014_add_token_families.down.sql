@@ -0,0 +1,5 @@
+drop index if exists tokens_family_id_idx;
+
+alter table tokens drop column if exists used_at;
+alter table tokens drop column if exists parent_hash;
+alter table tokens drop column if exists family_id;
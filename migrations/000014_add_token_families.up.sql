@@ -0,0 +1,9 @@
+-- Refresh tokens and the access tokens issued alongside them belong to a
+-- family, identified by the hash of the first refresh token in it. Each
+-- rotated refresh token records the hash of the one it replaced, and used
+-- refresh tokens are kept until they expire so that reuse can be detected.
+alter table tokens add column if not exists family_id   bytea;
+alter table tokens add column if not exists parent_hash bytea;
+alter table tokens add column if not exists used_at     timestamp(0) with time zone;
+
+create index if not exists tokens_family_id_idx on tokens (family_id);
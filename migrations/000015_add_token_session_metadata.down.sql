@@ -0,0 +1,8 @@
+drop index if exists tokens_session_id_idx;
+
+alter table tokens drop column if exists device_label;
+alter table tokens drop column if exists ip;
+alter table tokens drop column if exists user_agent;
+alter table tokens drop column if exists last_used_at;
+alter table tokens drop column if exists created_at;
+alter table tokens drop column if exists session_id;
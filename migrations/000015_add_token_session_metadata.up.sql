@@ -0,0 +1,11 @@
+-- Tokens that represent a user's sign in carry a non-secret session ID, shared
+-- by every token in a refresh token family, and metadata describing where the
+-- session was established. created_at records when the session began.
+alter table tokens add column if not exists session_id   text;
+alter table tokens add column if not exists created_at   timestamp(0) with time zone not null default now();
+alter table tokens add column if not exists last_used_at timestamp(0) with time zone;
+alter table tokens add column if not exists user_agent   text;
+alter table tokens add column if not exists ip           text;
+alter table tokens add column if not exists device_label text;
+
+create index if not exists tokens_session_id_idx on tokens (session_id);
@@ -0,0 +1,17 @@
+-- A user's TOTP (RFC 6238) secret, encrypted with the MFA master key. The
+-- secret is only used to authenticate once enrollment has been confirmed, and
+-- last_used_step prevents a code from being used more than once.
+create table if not exists user_totp (
+    user_id        bigint primary key references users(id) on delete cascade,
+    created_at     timestamp(0) with time zone not null default now(),
+    confirmed_at   timestamp(0) with time zone,
+    secret         bytea not null,
+    last_used_step bigint not null default 0
+);
+
+-- SHA-256 hashes of a user's unused single-use recovery codes.
+create table if not exists user_recovery_codes (
+    user_id bigint not null references users(id) on delete cascade,
+    hash    bytea not null,
+    primary key (user_id, hash)
+);
@@ -0,0 +1,33 @@
+-- A user's WebAuthn public key credentials (passkeys and security keys).
+-- sign_count is the last signature counter reported by the authenticator and
+-- clone_warning is set if it ever fails to increase, which suggests that the
+-- credential has been copied.
+create table if not exists webauthn_credentials (
+    id               bigserial primary key,
+    user_id          bigint not null references users(id) on delete cascade,
+    credential_id    bytea not null unique,
+    public_key       bytea not null,
+    attestation_type text not null default '',
+    transports       text[] not null default '{}',
+    aaguid           bytea,
+    sign_count       bigint not null default 0,
+    clone_warning    boolean not null default false,
+    backup_eligible  boolean not null default false,
+    backup_state     boolean not null default false,
+    name             text not null default '',
+    created_at       timestamp(0) with time zone not null default now(),
+    last_used_at     timestamp(0) with time zone
+);
+
+create index if not exists webauthn_credentials_user_id_idx
+    on webauthn_credentials (user_id);
+
+-- The state of registration and sign in ceremonies that are in progress, keyed
+-- by the SHA-256 hash of a token given to the client when it was started.
+create table if not exists webauthn_ceremonies (
+    hash     bytea primary key,
+    user_id  bigint references users(id) on delete cascade,
+    ceremony text not null,
+    session  jsonb not null,
+    expiry   timestamp(0) with time zone not null
+);
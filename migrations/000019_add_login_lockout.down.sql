@@ -0,0 +1,5 @@
+drop table if exists ip_login_failures;
+
+alter table users drop column if exists locked_until;
+alter table users drop column if exists last_failed_login_at;
+alter table users drop column if exists failed_login_count;
@@ -0,0 +1,14 @@
+-- Consecutive failed sign in attempts against each account. An account whose
+-- locked_until is in the future cannot be signed in to with a password.
+alter table users add column if not exists failed_login_count   integer not null default 0;
+alter table users add column if not exists last_failed_login_at timestamp(0) with time zone;
+alter table users add column if not exists locked_until         timestamp(0) with time zone;
+
+-- Consecutive failed sign in attempts from each source IP address, against any
+-- account.
+create table if not exists ip_login_failures (
+    ip                   text primary key,
+    failed_login_count   integer not null default 0,
+    last_failed_login_at timestamp(0) with time zone not null,
+    locked_until         timestamp(0) with time zone
+);
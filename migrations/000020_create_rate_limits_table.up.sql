@@ -0,0 +1,11 @@
+-- Token buckets used to rate limit requests when running more than one replica.
+-- tokens is the number of requests left as of updated_at, and a bucket can be
+-- deleted once expires_at has passed, as it will have refilled completely.
+create table if not exists rate_limits (
+    key        text primary key,
+    tokens     double precision not null,
+    updated_at timestamp with time zone not null,
+    expires_at timestamp with time zone not null
+);
+
+create index if not exists rate_limits_expires_at_idx on rate_limits (expires_at);